@@ -0,0 +1,95 @@
+//
+// Copyright (c) 2025 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.libvirt-usb-hotplugd nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"fmt"
+	"strings"
+)
+
+// checkConfig looks for rules that are valid but most likely not what the user wants. The
+// devices are used to find matchers that match no or more than one device, these checks are
+// skipped if devices is nil. Only matchers which identify a single device are expected to match
+// at most one device.
+func checkConfig(conf *Config, devices map[string]Device) (warnings []string) {
+	for _, mname := range conf.shadowed {
+		warnings = append(warnings, fmt.Sprintf("machine '%s' of the main config file is replaced by machines.d/%s.yml", mname, mname))
+	}
+
+	for idx, matcher := range conf.NeverAttach {
+		if matcher.onlyBusAndDevice() {
+			warnings = append(warnings, fmt.Sprintf("never-attach list: device matcher %d only uses bus and device numbers which change when devices are reconnected", idx))
+		}
+	}
+	slugs := sortedDeviceSlugs(devices)
+	for _, mname := range sortedMachineNames(conf) {
+		mconf := conf.Machines[mname]
+		for idx, matcher := range mconf.Exclude {
+			if matcher.onlyBusAndDevice() {
+				warnings = append(warnings, fmt.Sprintf("machine '%s': exclude matcher %d only uses bus and device numbers which change when devices are reconnected", mname, idx))
+			}
+		}
+		for idx, matcher := range mconf.DeviceMatchers {
+			if matcher.onlyBusAndDevice() {
+				warnings = append(warnings, fmt.Sprintf("machine '%s': device matcher %d only uses bus and device numbers which change when devices are reconnected", mname, idx))
+			}
+			if devices == nil {
+				continue
+			}
+			var matched []string
+			for _, slug := range slugs {
+				if device := devices[slug]; device.Matches(matcher) {
+					matched = append(matched, device.String())
+				}
+			}
+			switch {
+			case len(matched) == 0:
+				warnings = append(warnings, fmt.Sprintf("machine '%s': device matcher %d does not match any device currently connected", mname, idx))
+			case len(matched) > 1 && matcher.identifiesSingleDevice():
+				warnings = append(warnings, fmt.Sprintf("machine '%s': device matcher %d matches %d devices currently connected: %s", mname, idx, len(matched), strings.Join(matched, "; ")))
+			}
+		}
+	}
+
+	for _, slug := range slugs {
+		device := devices[slug]
+		mnames := matchingMachines(conf, device)
+		if len(mnames) < 2 {
+			continue
+		}
+		warning := fmt.Sprintf("device '%s' is matched by more than one machine: %s", device.String(), strings.Join(machineKeys(conf, mnames), ", "))
+		if conf.Machines[mnames[0]].Priority == conf.Machines[mnames[1]].Priority {
+			warning += ", the machines with the highest priority are only ordered by name"
+		}
+		warnings = append(warnings, warning)
+	}
+	return
+}
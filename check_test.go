@@ -0,0 +1,91 @@
+//
+// Copyright (c) 2025 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.libvirt-usb-hotplugd nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+)
+
+func TestCheckConfigMultipleMatches(t *testing.T) {
+	// two identical webcams which only differ in their serial number and port
+	webcams := make([]Device, 2)
+	for i := range webcams {
+		d := testDevice(3, 5+i, 0x046d, 0x0825)
+		d.SetPort(fmt.Sprintf("3-%d", 1+i))
+		d.Udev.Env["ID_VENDOR"] = "Logitech"
+		d.Udev.Env["ID_SERIAL"] = fmt.Sprintf("Logitech_C270_%d", i)
+		d.Interfaces = []USBInterface{{Number: 0, Class: 0x0e, SubClass: 0x01}}
+		d.Children = []ChildDevice{{Path: "/sys/devices/video", Subsystem: "video4linux"}}
+		d.Sysfs.Attrs = map[string]string{"speed": "480"}
+		webcams[i] = d
+	}
+	devices := testDeviceMap(webcams...)
+
+	tests := []struct {
+		matcher string
+		warning bool
+	}{
+		{"{vendor-id: 0x046d, product-id: 0x0825}", true},
+		{"all: [{vendor-id: 0x046d}, {product-id: 0x0825}]", true},
+		{"{bus: 3, udev: {env: [{name: ID_VENDOR, equals: Logitech}]}}", false},
+		{"vendor-id: [0x046d, 0x1050]", false},
+		{"product-id: 0x0800-0x08ff", false},
+		{"behind-hub: usb3", false},
+		{"interfaces: [{class: 0x0e}]", false},
+		{"children: [{subsystem: video4linux}]", false},
+		{"udev: {env: [{name: ID_SERIAL, glob: 'Logitech_*'}]}", false},
+		{"udev: {env: [{name: ID_SERIAL, pattern: '^Logitech_'}]}", false},
+		{"udev: {env: [{name: ID_SERIAL, one-of: [Logitech_C270_0, Logitech_C270_1]}]}", false},
+		{"sysfs: {attr: [{name: speed, min: 480}]}", false},
+		{"sysfs: {attr: [{name: speed, max: 480}]}", false},
+		{"any: [{port: 3-1}, {port: 3-2}]", false},
+		{"{vendor-id: 0x046d, not: {port: 3-3}}", false},
+	}
+	var text strings.Builder
+	text.WriteString("machines:\n")
+	for i, test := range tests {
+		fmt.Fprintf(&text, "  vm%d:\n    devices:\n    - %s\n", i, test.matcher)
+	}
+	conf := readTestConfig(t, text.String())
+	warnings := checkConfig(conf, devices)
+	for i, test := range tests {
+		prefix := fmt.Sprintf("machine 'vm%d': device matcher 0 matches 2 devices", i)
+		warned := false
+		for _, warning := range warnings {
+			warned = warned || strings.HasPrefix(warning, prefix)
+		}
+		if warned != test.warning {
+			t.Errorf("%q: got multiple matches warning %t, want %t", test.matcher, warned, test.warning)
+		}
+	}
+}
@@ -0,0 +1,870 @@
+//
+// Copyright (c) 2025 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.libvirt-usb-hotplugd nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strings"
+	"syscall"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	libvirtConnectTimeout = 10 * time.Second
+	ueventSettleTime      = 500 * time.Millisecond
+)
+
+type command struct {
+	name        string
+	usage       string
+	description string
+	run         func(args []string) int
+}
+
+// commands is populated by init() since the commands themselves look up their usage here
+var commands []command
+
+func init() {
+	commands = []command{
+		{"run", "[options] <config-file>", "run the daemon", cmdRun},
+		{"once", "[options] <config-file>", "do a single reconciliation pass and exit", cmdOnce},
+		{"plan", "[options] <config-file>", "show what a single reconciliation pass would do", cmdPlan},
+		{"evaluate", "[options] <config-file>", "show which machines the devices would be attached to", cmdEvaluate},
+		{"explain", "[options] <config-file> <device>", "show why a device did or did not match", cmdExplain},
+		{"check-config", "[options] <config-file>", "validate the configuration", cmdCheckConfig},
+		{"list-devices", "[options]", "list all USB devices", cmdListDevices},
+		{"learn", "[options] <config-file> <machine>", "add a matcher for a device by plugging it in", cmdLearn},
+		{"snapshot", "[options] <output-file>", "write all USB devices to a snapshot file", cmdSnapshot},
+		{"version", "", "print the version", cmdVersion},
+	}
+}
+
+func findCommand(name string) *command {
+	idx := slices.IndexFunc(commands, func(c command) bool { return c.name == name })
+	if idx < 0 {
+		return nil
+	}
+	return &commands[idx]
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "Usage: %s <command> [options]\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "       %s [options] <config-file>  (same as run)\n\n", os.Args[0])
+	fmt.Fprintf(os.Stderr, "Commands:\n")
+	for _, c := range commands {
+		fmt.Fprintf(os.Stderr, "  %-14s %s\n", c.name, c.description)
+	}
+	fmt.Fprintf(os.Stderr, "\nRun '%s <command> -h' for the options of a command.\n", os.Args[0])
+}
+
+func newCommandFlagSet(name string) *flag.FlagSet {
+	usage := findCommand(name).usage
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	fs.Usage = func() {
+		fmt.Fprintf(fs.Output(), "Usage: %s %s %s\n", os.Args[0], name, usage)
+		fs.PrintDefaults()
+	}
+	return fs
+}
+
+// commonOptions are the options of all commands which read the configuration file
+type commonOptions struct {
+	configfile string
+	overrides  ConfigOverrides
+	logLevel   string
+	logFormat  string
+}
+
+func newCommonOptions(fs *flag.FlagSet) *commonOptions {
+	o := &commonOptions{}
+	logLevel := logLevelInfo
+	if _, exists := os.LookupEnv(debugEnvVar); exists {
+		logLevel = logLevelDebug
+	}
+	fs.StringVar(&o.configfile, "config", "", "path to the config file, may also be given as the first argument")
+	fs.StringVar(&o.overrides.LibvirtURI, "libvirt-uri", "", "libvirt URI for all machines that don't set one, overrides the config file")
+	fs.StringVar(&o.overrides.Sysroot, "sysroot", "", "prefix for the paths of sysfs, the udev data directory and /dev")
+	fs.StringVar(&o.overrides.DeviceSnapshot, "device-snapshot", "", "read the devices from this snapshot file instead of the host")
+	fs.StringVar(&o.logLevel, "log-level", logLevel, "log level, one of: info, debug")
+	fs.StringVar(&o.logFormat, "log-format", logFormatText, "log format, one of: text, json")
+	return o
+}
+
+// parseArgs parses the arguments and returns the positional ones. Unlike fs.Parse options may
+// also follow positional arguments, i.e. 'plan config.yml -format json'. Everything after '--'
+// is treated as a positional argument.
+func parseArgs(fs *flag.FlagSet, args []string) []string {
+	var positional []string
+	for {
+		fs.Parse(args) //nolint:errcheck
+		rest := fs.Args()
+		if len(rest) == 0 {
+			return positional
+		}
+		// fs.Parse stops after consuming '--'
+		if len(rest) < len(args) && args[len(args)-len(rest)-1] == "--" {
+			return append(positional, rest...)
+		}
+		positional = append(positional, rest[0])
+		args = rest[1:]
+	}
+}
+
+// parse parses the arguments and sets up logging, info messages are written to logOutput.
+// Unless -config is used the config file is taken from the first positional argument. The
+// remaining positional arguments are returned.
+func (o *commonOptions) parse(fs *flag.FlagSet, args []string, logOutput io.Writer) ([]string, error) {
+	rest := parseArgs(fs, args)
+	if o.configfile == "" {
+		if len(rest) == 0 {
+			err := errors.New("no config file given")
+			fmt.Fprintf(fs.Output(), "%v\n", err)
+			return nil, err
+		}
+		o.configfile, rest = rest[0], rest[1:]
+	}
+	if err := setupLogging(o.logLevel, o.logFormat, logOutput); err != nil {
+		fmt.Fprintf(fs.Output(), "%v\n", err)
+		return nil, err
+	}
+	return rest, nil
+}
+
+// readConfig reads the config file and applies the settings that are global to the process
+func (o *commonOptions) readConfig() (*Config, error) {
+	conf, err := readConfig(o.configfile, o.overrides)
+	if err != nil {
+		return nil, err
+	}
+	sysroot = conf.Sysroot
+	deviceSnapshot = conf.DeviceSnapshot
+	return conf, nil
+}
+
+// sortedDeviceSlugs returns the slugs of all devices ordered by bus and device number
+func sortedDeviceSlugs(devices map[string]Device) []string {
+	slugs := make([]string, 0, len(devices))
+	for slug := range devices {
+		slugs = append(slugs, slug)
+	}
+	slices.Sort(slugs)
+	return slugs
+}
+
+func cmdSnapshot(args []string) int {
+	fs := newCommandFlagSet("snapshot")
+	sysrootFlag := fs.String("sysroot", "/", "prefix for the paths of sysfs, the udev data directory and /dev")
+	backend := fs.String("usb-backend", usbBackendSysfs, "the backend used to enumerate USB devices")
+	rest := parseArgs(fs, args)
+	if len(rest) != 1 {
+		fs.Usage()
+		return 1
+	}
+	// the snapshot might be written to stdout
+	wl.SetOutput(os.Stderr)
+	enumerator, exists := usbEnumerators[*backend]
+	if !exists {
+		fmt.Fprintf(os.Stderr, "usb-backend '%s' is not available\n", *backend)
+		return 1
+	}
+	if !filepath.IsAbs(*sysrootFlag) {
+		fmt.Fprintf(os.Stderr, "sysroot '%s' must be an absolute path\n", *sysrootFlag)
+		return 1
+	}
+	sysroot = *sysrootFlag
+
+	devices, err := ListUSBDevices(enumerator, sysfsAttrsAll)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list usb devices: %v\n", err)
+		return 1
+	}
+	if err = NewSnapshot(devices).Write(rest[0]); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// cmdEvaluate shows which machines the devices would be attached to if all machines were
+// running. This only needs the config and the devices and does not talk to libvirt at all.
+func cmdEvaluate(args []string) int {
+	fs := newCommandFlagSet("evaluate")
+	o := newCommonOptions(fs)
+	if rest, err := o.parse(fs, args, os.Stderr); err != nil || len(rest) != 0 {
+		fs.Usage()
+		return 1
+	}
+	conf, err := o.readConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse config: %v\n", err)
+		return 1
+	}
+
+	devices, err := ListDevices(conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list usb devices: %v\n", err)
+		return 1
+	}
+	for _, slug := range sortedDeviceSlugs(devices) {
+		device := devices[slug]
+		if conf.NeverAttaches(device) {
+			fmt.Printf("%s: never attached\n", device.String())
+			continue
+		}
+		mnames := matchingMachines(conf, device)
+		switch len(mnames) {
+		case 0:
+			fmt.Printf("%s: -\n", device.String())
+		case 1:
+			fmt.Printf("%s: %s\n", device.String(), conf.Machines[mnames[0]].Key())
+		default:
+			others := make([]string, 0, len(mnames)-1)
+			for _, mname := range mnames[1:] {
+				others = append(others, conf.Machines[mname].Key())
+			}
+			fmt.Printf("%s: %s (also matched by: %s)\n", device.String(), conf.Machines[mnames[0]].Key(), strings.Join(others, ", "))
+		}
+	}
+	return 0
+}
+
+// connectLibvirt opens the connections to all libvirt URIs used by the configuration and
+// waits for them to be established. Machines of URIs that could not be reached are treated
+// as not running.
+func connectLibvirt(ctx context.Context, conf *Config, timeout time.Duration) (*LibvirtConnections, error) {
+	conns := NewLibvirtConnections(ctx)
+	if err := conns.Update(conf); err != nil {
+		return nil, fmt.Errorf("failed to initialize libvirt connections: %v", err)
+	}
+	waitCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	if err := conns.WaitConnected(waitCtx, conf); err != nil {
+		wl.Printf("%v, machines using these connections are treated as not running", err)
+	}
+	return conns, nil
+}
+
+func startUeventMonitor(source string, events chan<- Uevent) *UeventMonitor {
+	if source == ueventSourceDisabled {
+		wl.Printf("uevents are disabled, only using periodic scans")
+		return nil
+	}
+	monitor, err := NewUeventMonitor(source)
+	if err != nil {
+		wl.Printf("failed to start uevent monitor: %v, only using periodic scans", err)
+		return nil
+	}
+	go monitor.Run(events)
+	wdl.Printf("listening for uevents sent by %s", source)
+	return monitor
+}
+
+func startControlServer(conf ControlConfig, requests chan<- ControlRequest) *ControlServer {
+	if conf.Socket == "" {
+		return nil
+	}
+	server, err := NewControlServer(conf, requests)
+	if err != nil {
+		wl.Printf("failed to start control server: %v, control socket is disabled", err)
+		return nil
+	}
+	go server.Run()
+	wl.Printf("listening for control requests on %s", conf.Socket)
+	return server
+}
+
+// checkDeviceSnapshot makes sure the devices of a snapshot, which most likely has been taken
+// on another host, are never attached to or detached from the local machines.
+func checkDeviceSnapshot(conf *Config, dryRun bool) error {
+	if conf.DeviceSnapshot != "" && !dryRun {
+		return fmt.Errorf("device-snapshot may only be used together with -dry-run")
+	}
+	return nil
+}
+
+// cmdOnce does a single reconciliation pass. It exits with a non-zero status if any of the
+// machines could not be listed, i.e. because their libvirt connection is unreachable, or any
+// of the actions failed.
+func cmdOnce(args []string) int {
+	fs := newCommandFlagSet("once")
+	o := newCommonOptions(fs)
+	dryRun := fs.Bool("dry-run", false, "only log the actions instead of attaching or detaching devices")
+	timeout := fs.Duration("timeout", libvirtConnectTimeout, "how long to wait for the connections to libvirt")
+	if rest, err := o.parse(fs, args, os.Stdout); err != nil || len(rest) != 0 {
+		fs.Usage()
+		return 1
+	}
+	conf, err := o.readConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse config: %v\n", err)
+		return 1
+	}
+	if err = checkDeviceSnapshot(conf, *dryRun); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conns, err := connectLibvirt(ctx, conf, *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	r := NewReconciler(conns)
+	r.DryRun = *dryRun
+	plan, err := r.Plan(conf)
+	if err != nil {
+		wl.Printf("%v", err)
+		return 1
+	}
+	status := 0
+	if len(plan.errs) > 0 || len(plan.unreachable) > 0 {
+		status = 1
+	}
+	if err = r.Apply(plan); err != nil {
+		status = 1
+	}
+	return status
+}
+
+// cmdRun runs the daemon
+func cmdRun(args []string) int {
+	fs := newCommandFlagSet("run")
+	o := newCommonOptions(fs)
+	dryRun := fs.Bool("dry-run", false, "only log the actions instead of attaching or detaching devices")
+	if rest, err := o.parse(fs, args, os.Stdout); err != nil || len(rest) != 0 {
+		fs.Usage()
+		return 1
+	}
+	conf, err := o.readConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse config: %v\n", err)
+		return 1
+	}
+	if err = checkDeviceSnapshot(conf, *dryRun); err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	wl.Printf("starting...")
+
+	sigs := make(chan os.Signal, 1)
+	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	events := make(chan Uevent, 32)
+	monitor := startUeventMonitor(conf.UeventSource, events)
+	interval := conf.scanInterval(monitor)
+	ticker := time.NewTicker(interval)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// the first run will happen as soon as the connections to libvirt have been established
+	conns := NewLibvirtConnections(ctx)
+	if err = conns.Update(conf); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to initialize libvirt connections: %v\n", err)
+		return 1
+	}
+	r := NewReconciler(conns)
+	r.DryRun = *dryRun
+	requests := make(chan ControlRequest)
+	control := startControlServer(conf.Control, requests)
+	defer func() {
+		if control != nil {
+			control.Close() //nolint:errcheck
+		}
+	}()
+
+	reload := func() error {
+		newconf, err := readConfig(o.configfile, o.overrides)
+		if err != nil {
+			return fmt.Errorf("failed to parse config: %v", err)
+		}
+		if err = checkDeviceSnapshot(newconf, *dryRun); err != nil {
+			return err
+		}
+		if err = conns.Update(newconf); err != nil {
+			return fmt.Errorf("failed to update libvirt connections: %v", err)
+		}
+		if newconf.UeventSource != conf.UeventSource {
+			if monitor != nil {
+				monitor.Close() //nolint:errcheck
+			}
+			monitor = startUeventMonitor(newconf.UeventSource, events)
+		}
+		if newInterval := newconf.scanInterval(monitor); newInterval != interval {
+			ticker.Reset(newInterval)
+			interval = newInterval
+		}
+		if !newconf.Control.equal(conf.Control) {
+			// this aborts pending requests, including a reload requested via the old socket
+			if control != nil {
+				control.Close() //nolint:errcheck
+			}
+			control = startControlServer(newconf.Control, requests)
+		}
+		sysroot = newconf.Sysroot
+		deviceSnapshot = newconf.DeviceSnapshot
+		conf = newconf
+		wl.Printf("successfully reloaded configuration from: %s", o.configfile)
+		return nil
+	}
+
+	// while paused the daemon keeps track of events but does not reconcile until resumed
+	paused := false
+	// plugging in a device generates a burst of events, wait for things to settle before running
+	var settle <-chan time.Time
+	for {
+		select {
+		case signal := <-sigs:
+			if signal == syscall.SIGHUP {
+				if err := reload(); err != nil {
+					wl.Printf("%v, keeping old configuration", err)
+				}
+				continue
+			}
+			wl.Printf("closing after receiving signal: %s", signal.String())
+			if monitor != nil {
+				monitor.Close() //nolint:errcheck
+			}
+			return 0
+		case req := <-requests:
+			var resp ControlResponse
+			switch req.Type {
+			case ControlStatus:
+				resp.Status = r.Status(conf)
+				resp.Status.ConfigFile = o.configfile
+				resp.Status.Paused = paused
+			case ControlReconcile:
+				if paused {
+					resp.Err = ErrReconcilePaused
+					break
+				}
+				wl.Printf("reconciliation requested via control socket")
+				r.Run(conf)
+				_, resp.Err = r.LastRun()
+			case ControlReload:
+				if resp.Err = reload(); resp.Err != nil {
+					wl.Printf("%v, keeping old configuration", resp.Err)
+				}
+			case ControlPause:
+				if !paused {
+					wl.Printf("reconciliation has been paused via control socket")
+				}
+				paused = true
+			case ControlResume:
+				if paused {
+					wl.Printf("reconciliation has been resumed via control socket")
+					paused = false
+					r.Run(conf)
+				}
+			}
+			req.Reply <- resp
+		case event := <-events:
+			wdl.Printf("received uevent: %s", event.String())
+			if settle == nil {
+				settle = time.After(ueventSettleTime)
+			}
+		case uri := <-conns.Connected:
+			if names := conf.MachinesOfLibvirtURI(uri); len(names) > 0 && !paused {
+				r.Run(conf, names...)
+			}
+		case event := <-conns.Events:
+			mname, exists := conf.MachineByDomain(event.URI, event.Domain)
+			if !exists {
+				continue
+			}
+			wl.Printf("machine '%s' has been %s", conf.Machines[mname].Key(), event.String())
+			// if a machine has stopped, some of its devices might need to be moved to other machines
+			if !paused {
+				r.Run(conf, mname)
+			}
+		case <-settle:
+			settle = nil
+			if len(conf.Machines) == 0 || paused {
+				continue
+			}
+			r.Run(conf)
+		case <-ticker.C:
+			if len(conf.Machines) == 0 || paused {
+				// no machines found in config - no need to scan for devices, but keep running in case the config changes
+				continue
+			}
+			r.Run(conf)
+		}
+
+	}
+}
+
+// cmdPlan runs a single reconciliation pass and prints the resulting actions instead of
+// applying them.
+func cmdPlan(args []string) int {
+	fs := newCommandFlagSet("plan")
+	o := newCommonOptions(fs)
+	format := fs.String("format", "text", "output format, one of: text, json")
+	timeout := fs.Duration("timeout", libvirtConnectTimeout, "how long to wait for the connections to libvirt")
+	// keep stdout clean for the plan
+	if rest, err := o.parse(fs, args, os.Stderr); err != nil || len(rest) != 0 || (*format != "text" && *format != "json") {
+		fs.Usage()
+		return 1
+	}
+	conf, err := o.readConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse config: %v\n", err)
+		return 1
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	conns, err := connectLibvirt(ctx, conf, *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	plan, err := NewReconciler(conns).Plan(conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err = encoder.Encode(plan); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to encode plan: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	if len(plan.Actions) == 0 {
+		fmt.Println("nothing to do")
+	}
+	for _, action := range plan.Actions {
+		fmt.Println(action.String())
+	}
+	return 0
+}
+
+// cmdExplain shows how every matcher of the configuration has been evaluated for a single device
+func cmdExplain(args []string) int {
+	fs := newCommandFlagSet("explain")
+	o := newCommonOptions(fs)
+	format := fs.String("format", "text", "output format, one of: text, json")
+	rest, err := o.parse(fs, args, os.Stderr)
+	if err != nil || len(rest) != 1 || (*format != "text" && *format != "json") {
+		fs.Usage()
+		return 1
+	}
+	conf, err := o.readConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse config: %v\n", err)
+		return 1
+	}
+
+	devices, err := ListDevices(conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list usb devices: %v\n", err)
+		return 1
+	}
+	device, err := FindDevice(devices, rest[0])
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	explanation := ExplainDevice(conf, device)
+	if *format == "json" {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err = encoder.Encode(explanation); err != nil {
+			fmt.Fprintf(os.Stderr, "failed to encode explanation: %v\n", err)
+			return 1
+		}
+		return 0
+	}
+	explanation.WriteText(os.Stdout)
+	return 0
+}
+
+// cmdListDevices prints all devices including the udev information relevant for matchers
+func cmdListDevices(args []string) int {
+	fs := newCommandFlagSet("list-devices")
+	conf := &Config{}
+	fs.StringVar(&conf.Sysroot, "sysroot", "/", "prefix for the paths of sysfs, the udev data directory and /dev")
+	fs.StringVar(&conf.USBBackend, "usb-backend", usbBackendSysfs, "the backend used to enumerate USB devices")
+	fs.StringVar(&conf.DeviceSnapshot, "device-snapshot", "", "read the devices from this snapshot file instead of the host")
+	format := fs.String("format", "text", "output format, one of: text, json, yaml")
+	withMatcher := fs.Bool("matcher", false, "add a device matcher snippet for every device")
+	tree := fs.Bool("tree", false, "only show the devices grouped by the hubs they are connected to")
+	if rest := parseArgs(fs, args); len(rest) != 0 || !slices.Contains([]string{"text", "json", "yaml"}, *format) {
+		fs.Usage()
+		return 1
+	}
+	if *tree && *format != "text" {
+		fmt.Fprintf(os.Stderr, "-tree only supports the text format\n")
+		return 1
+	}
+	wl.SetOutput(os.Stderr)
+	if _, exists := usbEnumerators[conf.USBBackend]; !exists {
+		fmt.Fprintf(os.Stderr, "usb-backend '%s' is not available\n", conf.USBBackend)
+		return 1
+	}
+	if !filepath.IsAbs(conf.Sysroot) {
+		fmt.Fprintf(os.Stderr, "sysroot '%s' must be an absolute path\n", conf.Sysroot)
+		return 1
+	}
+	sysroot = conf.Sysroot
+	deviceSnapshot = conf.DeviceSnapshot
+
+	var devices map[string]Device
+	var err error
+	if conf.DeviceSnapshot != "" {
+		devices, err = ListDevices(conf)
+	} else {
+		devices, err = ListUSBDevices(usbEnumerators[conf.USBBackend], sysfsAttrsAll)
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list usb devices: %v\n", err)
+		return 1
+	}
+	if *tree {
+		writeDeviceTree(os.Stdout, devices)
+		return 0
+	}
+
+	entries := make([]deviceListEntry, 0, len(devices))
+	for _, slug := range sortedDeviceSlugs(devices) {
+		entry, err := newDeviceListEntry(devices[slug], *withMatcher)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "%v\n", err)
+			return 1
+		}
+		entries = append(entries, entry)
+	}
+	switch *format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		err = encoder.Encode(entries)
+	case "yaml":
+		encoder := yaml.NewEncoder(os.Stdout)
+		encoder.SetIndent(2)
+		err = encoder.Encode(entries)
+	default:
+		for _, entry := range entries {
+			entry.WriteText(os.Stdout)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to encode devices: %v\n", err)
+		return 1
+	}
+	return 0
+}
+
+// cmdLearn waits for a device to be plugged in and adds a matcher for it to the config
+// snippet of the machine in the machines.d directory.
+func cmdLearn(args []string) int {
+	fs := newCommandFlagSet("learn")
+	o := newCommonOptions(fs)
+	timeout := fs.Duration("timeout", time.Minute, "how long to wait for the device to be plugged in")
+	yes := fs.Bool("yes", false, "don't ask for confirmation before writing the config snippet")
+	rest, err := o.parse(fs, args, os.Stderr)
+	if err != nil || len(rest) != 1 {
+		fs.Usage()
+		return 1
+	}
+	configfile, mname := o.configfile, rest[0]
+	if mname == "" || filepath.Base(mname) != mname || strings.HasPrefix(mname, ".") {
+		fmt.Fprintf(os.Stderr, "invalid machine name '%s'\n", mname)
+		return 1
+	}
+	conf, err := o.readConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to parse config: %v\n", err)
+		return 1
+	}
+	if conf.DeviceSnapshot != "" {
+		fmt.Fprintf(os.Stderr, "learn does not work with device-snapshot, it needs to watch the devices of the host\n")
+		return 1
+	}
+
+	machinesDir, err := machinesDirectory(configfile)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	filename := filepath.Join(machinesDir, mname+".yml")
+	if _, err := os.Stat(filename); os.IsNotExist(err) {
+		if _, exists := conf.Machines[mname]; exists {
+			// a new snippet would replace the machine of the main config file
+			fmt.Fprintf(os.Stderr, "machine '%s' is defined in %s, please add the matcher there\n", mname, configfile)
+			return 1
+		}
+	}
+
+	before, err := ListDevices(conf)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to list usb devices: %v\n", err)
+		return 1
+	}
+	fmt.Printf("please plug in the device which should be attached to machine '%s'...\n", mname)
+	device, devices, err := waitForNewDevice(conf, before, *timeout)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	fmt.Printf("found new device: %s\n", device.String())
+
+	snippet, matcher, err := SuggestMatcher(device)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	fmt.Printf("\nproposed matcher:\n\n%s\n", snippet)
+	for _, slug := range sortedDeviceSlugs(devices) {
+		if other := devices[slug]; slug != device.Slug() && other.Matches(matcher) {
+			fmt.Printf("WARNING: this matcher also matches the device: %s\n", other.String())
+		}
+	}
+	if mnames := matchingMachines(conf, device); len(mnames) > 0 {
+		fmt.Printf("WARNING: the device is already matched by: %s\n", strings.Join(machineKeys(conf, mnames), ", "))
+	}
+	if conf.NeverAttaches(device) {
+		fmt.Printf("WARNING: the device is on the never-attach list\n")
+	}
+
+	if !*yes {
+		fmt.Printf("add this matcher to %s? [y/N] ", filename)
+		answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+		if answer = strings.ToLower(strings.TrimSpace(answer)); answer != "y" && answer != "yes" {
+			fmt.Printf("aborted\n")
+			return 1
+		}
+	}
+
+	old, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		fmt.Fprintf(os.Stderr, "%v\n", err)
+		return 1
+	}
+	if err = addMatcherToMachineFile(filename, snippet); err != nil {
+		fmt.Fprintf(os.Stderr, "failed to update %s: %v\n", filename, err)
+		return 1
+	}
+	if _, err = readConfig(configfile, o.overrides); err != nil {
+		// don't leave a broken configuration behind
+		if old == nil {
+			os.Remove(filename) //nolint:errcheck
+		} else {
+			os.WriteFile(filename, old, 0644) //nolint:errcheck
+		}
+		fmt.Fprintf(os.Stderr, "the resulting configuration is invalid, %s has been restored: %v\n", filename, err)
+		return 1
+	}
+	fmt.Printf("successfully added the matcher to %s, reload the daemon to apply it\n", filename)
+	return 0
+}
+
+// cmdCheckConfig validates the configuration and reports rules which are most likely not
+// what the user wants. It exits with 1 on errors and, if -strict is set, with 2 on warnings.
+func cmdCheckConfig(args []string) int {
+	fs := newCommandFlagSet("check-config")
+	o := newCommonOptions(fs)
+	strict := fs.Bool("strict", false, "exit with a non-zero status if there are warnings")
+	noLibvirt := fs.Bool("no-libvirt", false, "don't check whether the domains of the machines exist")
+	timeout := fs.Duration("timeout", libvirtConnectTimeout, "how long to wait for the connections to libvirt")
+	// keep stdout clean for the results
+	if rest, err := o.parse(fs, args, os.Stderr); err != nil || len(rest) != 0 {
+		fs.Usage()
+		return 1
+	}
+	conf, err := o.readConfig()
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		return 1
+	}
+
+	var warnings []string
+	devices, err := ListDevices(conf)
+	if err != nil {
+		warnings = append(warnings, fmt.Sprintf("failed to list usb devices: %v, the matchers have not been checked against the connected devices", err))
+	}
+	warnings = append(warnings, checkConfig(conf, devices)...)
+
+	if !*noLibvirt && len(conf.Machines) > 0 {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		conns, err := connectLibvirt(ctx, conf, *timeout)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: %v\n", err)
+			return 1
+		}
+		missing, unreachable, err := MissingVirtualMachines(conns, conf)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "error: failed to look up domains: %v\n", err)
+			return 1
+		}
+		for _, mname := range missing {
+			warnings = append(warnings, fmt.Sprintf("machine '%s': domain does not exist in libvirt (%s)", mname, conf.Machines[mname].Key()))
+		}
+		for _, uri := range unreachable {
+			warnings = append(warnings, fmt.Sprintf("failed to connect to libvirt at %s, the domains of its machines have not been checked", uri))
+		}
+	}
+
+	for _, warning := range warnings {
+		fmt.Printf("warning: %s\n", warning)
+	}
+	if len(warnings) == 0 {
+		fmt.Printf("config is valid\n")
+		return 0
+	}
+	fmt.Printf("config is valid but has %d warning(s)\n", len(warnings))
+	if *strict {
+		return 2
+	}
+	return 0
+}
+
+func cmdVersion(args []string) int {
+	fmt.Printf("whawty-libvirt-usb-hotplugd %s (%s, %s/%s)\n", versionString(), runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	return 0
+}
@@ -32,41 +32,730 @@ package main
 
 import (
 	"fmt"
+	"math"
+	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"slices"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/digitalocean/go-libvirt"
 	"gopkg.in/yaml.v3"
 )
 
-type UdevEnvMatcher struct {
-	Name    string  `yaml:"name"`
-	Equals  *string `yaml:"equals"`
-	Pattern *string `yaml:"pattern"`
-	re      *regexp.Regexp
+// NumberRange is an inclusive range of numbers
+type NumberRange struct {
+	Min int64
+	Max int64
+}
+
+func (r NumberRange) String() string {
+	if r.Min == r.Max {
+		return strconv.FormatInt(r.Min, 10)
+	}
+	return fmt.Sprintf("%d-%d", r.Min, r.Max)
+}
+
+// NumberSet contains all numbers within any of its ranges. In YAML it may be written as a
+// single number, a range like '0x1f00-0x1fff' or a list of those.
+type NumberSet []NumberRange
+
+func parseNumber(str string) (int64, error) {
+	str = strings.TrimSpace(str)
+	if hex, found := strings.CutPrefix(strings.ToLower(str), "0x"); found {
+		return strconv.ParseInt(hex, 16, 64)
+	}
+	return strconv.ParseInt(str, 10, 64)
+}
+
+func parseNumberRange(node *yaml.Node) (r NumberRange, err error) {
+	if node.Kind != yaml.ScalarNode {
+		return r, fmt.Errorf("line %d: expected a number or a range", node.Line)
+	}
+	if node.Tag == "!!int" {
+		if err = node.Decode(&r.Min); err != nil {
+			return
+		}
+		r.Max = r.Min
+		return
+	}
+	start, end, found := strings.Cut(node.Value, "-")
+	if r.Min, err = parseNumber(start); err != nil {
+		return r, fmt.Errorf("line %d: invalid number '%s'", node.Line, start)
+	}
+	r.Max = r.Min
+	if found {
+		if r.Max, err = parseNumber(end); err != nil {
+			return r, fmt.Errorf("line %d: invalid number '%s'", node.Line, end)
+		}
+	}
+	if r.Min > r.Max {
+		return r, fmt.Errorf("line %d: invalid range '%s', the start must not be greater than the end", node.Line, node.Value)
+	}
+	return
+}
+
+func (s *NumberSet) UnmarshalYAML(node *yaml.Node) error {
+	nodes := []*yaml.Node{node}
+	if node.Kind == yaml.SequenceNode {
+		nodes = node.Content
+	}
+	*s = make(NumberSet, 0, len(nodes))
+	for _, n := range nodes {
+		r, err := parseNumberRange(n)
+		if err != nil {
+			return err
+		}
+		*s = append(*s, r)
+	}
+	return nil
+}
+
+func (s NumberSet) Contains(n int64) bool {
+	return slices.ContainsFunc(s, func(r NumberRange) bool { return n >= r.Min && n <= r.Max })
+}
+
+// isSingle returns true if the set contains exactly one number
+func (s NumberSet) isSingle() bool {
+	return len(s) == 1 && s[0].Min == s[0].Max
+}
+
+func (s NumberSet) String() string {
+	ranges := make([]string, 0, len(s))
+	for _, r := range s {
+		ranges = append(ranges, r.String())
+	}
+	return strings.Join(ranges, ",")
+}
+
+// hexString is like String but formats all numbers as 16-bit hex values
+func (s NumberSet) hexString() string {
+	ranges := make([]string, 0, len(s))
+	for _, r := range s {
+		if r.Min == r.Max {
+			ranges = append(ranges, fmt.Sprintf("0x%04x", r.Min))
+		} else {
+			ranges = append(ranges, fmt.Sprintf("0x%04x-0x%04x", r.Min, r.Max))
+		}
+	}
+	return strings.Join(ranges, ",")
+}
+
+// validate checks that the set is not empty and all numbers are within min and max
+func (s NumberSet) validate(min, max int64) error {
+	if len(s) == 0 {
+		return fmt.Errorf("must not be empty")
+	}
+	for _, r := range s {
+		if r.Min < min || r.Max > max {
+			return fmt.Errorf("%s is out of range, must be within %d-%d", r.String(), min, max)
+		}
+	}
+	return nil
+}
+
+// ValueMatcher matches the value of a named attribute like an udev environment variable
+// or a sysfs attribute. Exactly one of the operators must be set, Min and Max count as one.
+type ValueMatcher struct {
+	Name             string   `yaml:"name"`
+	Equals           *string  `yaml:"equals"`
+	EqualsIgnoreCase *string  `yaml:"equals-ignore-case"`
+	OneOf            []string `yaml:"one-of"`
+	Pattern          *string  `yaml:"pattern"`
+	Glob             *string  `yaml:"glob"`
+	Exists           *bool    `yaml:"exists"`
+	Absent           *bool    `yaml:"absent"`
+	// Min and Max are inclusive, Base is used to parse the value and defaults to 10
+	// unless the value starts with '0x'
+	Min  *int64 `yaml:"min"`
+	Max  *int64 `yaml:"max"`
+	Base *int   `yaml:"base"`
+	re   *regexp.Regexp
+}
+
+func (v *ValueMatcher) operators() (ops []string) {
+	if v.Equals != nil {
+		ops = append(ops, "equals")
+	}
+	if v.EqualsIgnoreCase != nil {
+		ops = append(ops, "equals-ignore-case")
+	}
+	if v.OneOf != nil {
+		ops = append(ops, "one-of")
+	}
+	if v.Pattern != nil {
+		ops = append(ops, "pattern")
+	}
+	if v.Glob != nil {
+		ops = append(ops, "glob")
+	}
+	if v.Exists != nil {
+		ops = append(ops, "exists")
+	}
+	if v.Absent != nil {
+		ops = append(ops, "absent")
+	}
+	if v.Min != nil {
+		ops = append(ops, "min")
+	} else if v.Max != nil {
+		ops = append(ops, "max")
+	}
+	return
+}
+
+// globToRegexp converts a shell pattern to a regular expression. This works like fnmatch(3)
+// without any flags, which is what udev uses: '*' and '?' also match '/' and leading dots.
+// Character classes like '[0-9]' can be negated using '!' or '^'. A backslash quotes the
+// next character.
+func globToRegexp(glob string) (*regexp.Regexp, error) {
+	pattern := []rune(glob)
+	var b strings.Builder
+	b.WriteString(`(?s)^`)
+	for i := 0; i < len(pattern); i++ {
+		switch c := pattern[i]; c {
+		case '*':
+			b.WriteString(`.*`)
+		case '?':
+			b.WriteString(`.`)
+		case '\\':
+			if i++; i == len(pattern) {
+				return nil, fmt.Errorf("trailing backslash")
+			}
+			b.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		case '[':
+			end := i + 1
+			if end < len(pattern) && (pattern[end] == '!' || pattern[end] == '^') {
+				end++
+			}
+			// a ']' right after the opening bracket is part of the class
+			if end < len(pattern) && pattern[end] == ']' {
+				end++
+			}
+			for end < len(pattern) && pattern[end] != ']' {
+				end++
+			}
+			if end == len(pattern) {
+				return nil, fmt.Errorf("missing ']' of character class")
+			}
+			class := pattern[i+1 : end]
+			b.WriteString(`[`)
+			if class[0] == '!' || class[0] == '^' {
+				b.WriteString(`^`)
+				class = class[1:]
+			}
+			for _, r := range class {
+				if strings.ContainsRune(`\[]^`, r) {
+					b.WriteRune('\\')
+				}
+				b.WriteRune(r)
+			}
+			b.WriteString(`]`)
+			i = end
+		default:
+			b.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+	b.WriteString(`$`)
+	return regexp.Compile(b.String())
+}
+
+// initialize validates the matcher, kind is used in error messages, i.e. 'udev-env'
+func (v *ValueMatcher) initialize(kind string) error {
+	if v.Name == "" {
+		return fmt.Errorf("%s name must not be empty", kind)
+	}
+	ops := v.operators()
+	if len(ops) == 0 {
+		return fmt.Errorf("%s needs at least one of 'equals', 'equals-ignore-case', 'one-of', 'pattern', 'glob', 'exists', 'absent', 'min' or 'max'", kind)
+	}
+	if len(ops) > 1 {
+		return fmt.Errorf("'%s' and '%s' are mutually exclusive", ops[0], ops[1])
+	}
+
+	switch {
+	case v.OneOf != nil && len(v.OneOf) == 0:
+		return fmt.Errorf("'one-of' must not be empty")
+	case v.Pattern != nil:
+		re, err := regexp.Compile(*v.Pattern)
+		if err != nil {
+			return fmt.Errorf("failed to compile pattern: %v", err)
+		}
+		v.re = re
+	case v.Glob != nil:
+		re, err := globToRegexp(*v.Glob)
+		if err != nil {
+			return fmt.Errorf("invalid glob: %v", err)
+		}
+		v.re = re
+	case v.Min != nil && v.Max != nil && *v.Min > *v.Max:
+		return fmt.Errorf("'min' must not be greater than 'max'")
+	}
+	if v.Base != nil {
+		if v.Min == nil && v.Max == nil {
+			return fmt.Errorf("'base' is only allowed together with 'min' or 'max'")
+		}
+		if *v.Base != 10 && *v.Base != 16 {
+			return fmt.Errorf("'base' must be either 10 or 16")
+		}
+	}
+	return nil
+}
+
+func (v *ValueMatcher) parseNumber(value string) (int64, error) {
+	if v.Base != nil && *v.Base == 16 {
+		return strconv.ParseInt(strings.TrimPrefix(strings.ToLower(value), "0x"), 16, 64)
+	}
+	return parseNumber(value)
+}
+
+// Matches returns true if the value of the attribute found in values matches
+func (v *ValueMatcher) Matches(values map[string]string) bool {
+	value, exists := values[v.Name]
+	switch {
+	case v.Exists != nil:
+		return exists == *v.Exists
+	case v.Absent != nil:
+		return exists != *v.Absent
+	case !exists:
+		return false
+	case v.Equals != nil:
+		return *v.Equals == value
+	case v.EqualsIgnoreCase != nil:
+		return strings.EqualFold(*v.EqualsIgnoreCase, value)
+	case v.OneOf != nil:
+		return slices.Contains(v.OneOf, value)
+	case v.re != nil:
+		// this is also used for globs
+		return v.re.MatchString(value)
+	case v.Min != nil || v.Max != nil:
+		number, err := v.parseNumber(strings.TrimSpace(value))
+		if err != nil {
+			return false
+		}
+		return (v.Min == nil || number >= *v.Min) && (v.Max == nil || number <= *v.Max)
+	}
+	return false
+}
+
+// String describes the condition of the matcher, i.e. "equals 'foo'"
+func (v *ValueMatcher) String() string {
+	switch {
+	case v.Exists != nil:
+		if *v.Exists {
+			return "exists"
+		}
+		return "does not exist"
+	case v.Absent != nil:
+		if *v.Absent {
+			return "absent"
+		}
+		return "not absent"
+	case v.Equals != nil:
+		return fmt.Sprintf("equals '%s'", *v.Equals)
+	case v.EqualsIgnoreCase != nil:
+		return fmt.Sprintf("equals-ignore-case '%s'", *v.EqualsIgnoreCase)
+	case v.OneOf != nil:
+		return fmt.Sprintf("one-of '%s'", strings.Join(v.OneOf, "', '"))
+	case v.Pattern != nil:
+		return fmt.Sprintf("pattern '%s'", *v.Pattern)
+	case v.Glob != nil:
+		return fmt.Sprintf("glob '%s'", *v.Glob)
+	}
+	var bounds []string
+	if v.Min != nil {
+		bounds = append(bounds, fmt.Sprintf("min %d", *v.Min))
+	}
+	if v.Max != nil {
+		bounds = append(bounds, fmt.Sprintf("max %d", *v.Max))
+	}
+	return strings.Join(bounds, " ")
+}
+
+type UdevMatcher struct {
+	Env         []ValueMatcher `yaml:"env"`
+	Tags        []string       `yaml:"tags"`
+	CurrentTags []string       `yaml:"current-tags"`
+	Symlinks    []string       `yaml:"symlinks"`
+}
+
+func (u *UdevMatcher) isEmpty() bool {
+	return len(u.Env) == 0 && len(u.Tags) == 0 && len(u.CurrentTags) == 0 && len(u.Symlinks) == 0
+}
+
+func (u *UdevMatcher) initialize() error {
+	for i := range u.Env {
+		if err := u.Env[i].initialize("udev-env"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (u *UdevMatcher) String() string {
+	var conds []string
+	for _, env := range u.Env {
+		conds = append(conds, fmt.Sprintf("env %s %s", env.Name, env.String()))
+	}
+	for _, tag := range u.Tags {
+		conds = append(conds, fmt.Sprintf("tag '%s'", tag))
+	}
+	for _, tag := range u.CurrentTags {
+		conds = append(conds, fmt.Sprintf("current-tag '%s'", tag))
+	}
+	for _, symlink := range u.Symlinks {
+		conds = append(conds, fmt.Sprintf("symlink '%s'", symlink))
+	}
+	return strings.Join(conds, ", ")
+}
+
+func (u *UdevMatcher) Matches(data UdevData) bool {
+	for _, env := range u.Env {
+		if !env.Matches(data.Env) {
+			return false
+		}
+	}
+	for _, tag := range u.Tags {
+		if !slices.Contains(data.Tags, tag) {
+			return false
+		}
+	}
+	for _, tag := range u.CurrentTags {
+		if !slices.Contains(data.CurrentTags, tag) {
+			return false
+		}
+	}
+	for _, symlink := range u.Symlinks {
+		if !slices.Contains(data.Symlinks, symlink) {
+			return false
+		}
+	}
+	return true
+}
+
+// InterfaceMatcher matches if the device has at least one interface with the given
+// class, subclass and protocol. Unset fields match any value.
+type InterfaceMatcher struct {
+	Class    *uint8 `yaml:"class"`
+	SubClass *uint8 `yaml:"subclass"`
+	Protocol *uint8 `yaml:"protocol"`
+}
+
+func (i *InterfaceMatcher) String() string {
+	field := func(v *uint8) string {
+		if v == nil {
+			return "*"
+		}
+		return fmt.Sprintf("%02x", *v)
+	}
+	return fmt.Sprintf("class=%s subclass=%s protocol=%s", field(i.Class), field(i.SubClass), field(i.Protocol))
+}
+
+func (i *InterfaceMatcher) Matches(intf USBInterface) bool {
+	if i.Class != nil && *i.Class != intf.Class {
+		return false
+	}
+	if i.SubClass != nil && *i.SubClass != intf.SubClass {
+		return false
+	}
+	if i.Protocol != nil && *i.Protocol != intf.Protocol {
+		return false
+	}
+	return true
+}
+
+// ChildMatcher matches if the device has at least one descendant device, i.e. a tty or
+// input device, with the given subsystem and udev properties.
+type ChildMatcher struct {
+	Subsystem *string     `yaml:"subsystem"`
+	Udev      UdevMatcher `yaml:"udev"`
+}
+
+func (c *ChildMatcher) String() string {
+	var conds []string
+	if c.Subsystem != nil {
+		conds = append(conds, fmt.Sprintf("subsystem '%s'", *c.Subsystem))
+	}
+	if !c.Udev.isEmpty() {
+		conds = append(conds, c.Udev.String())
+	}
+	if len(conds) == 0 {
+		return "any child device"
+	}
+	return strings.Join(conds, ", ")
+}
+
+func (c *ChildMatcher) Matches(child ChildDevice) bool {
+	if c.Subsystem != nil && *c.Subsystem != child.Subsystem {
+		return false
+	}
+	return c.Udev.Matches(child.Udev)
 }
 
 type DeviceMatcher struct {
-	Bus       *int    `yaml:"bus"`
-	Device    *int    `yaml:"device"`
-	VendorID  *uint16 `yaml:"vendor-id"`
-	ProductID *uint16 `yaml:"product-id"`
-	Udev      struct {
-		Env         []UdevEnvMatcher `yaml:"env"`
-		Tags        []string         `yaml:"tags"`
-		CurrentTags []string         `yaml:"current-tags"`
-	} `yaml:"udev"`
+	Bus        NumberSet          `yaml:"bus"`
+	Device     NumberSet          `yaml:"device"`
+	VendorID   NumberSet          `yaml:"vendor-id"`
+	ProductID  NumberSet          `yaml:"product-id"`
+	Udev       UdevMatcher        `yaml:"udev"`
+	HostNode   *string            `yaml:"host-node"`
+	Port       *string            `yaml:"port"`
+	BehindHub  *string            `yaml:"behind-hub"`
+	Interfaces []InterfaceMatcher `yaml:"interfaces"`
+	Children   []ChildMatcher     `yaml:"children"`
+	// Attr must match the attributes of the device itself while all entries of Attrs must
+	// match the attributes of either the device or one of its parents (like ATTR and ATTRS
+	// in udev rules).
+	Sysfs struct {
+		Attr  []ValueMatcher `yaml:"attr"`
+		Attrs []ValueMatcher `yaml:"attrs"`
+	} `yaml:"sysfs"`
+
+	// these combine nested matchers, all of them are and-ed with the rest of the matcher
+	All []DeviceMatcher `yaml:"all"`
+	Any []DeviceMatcher `yaml:"any"`
+	Not *DeviceMatcher  `yaml:"not"`
+}
+
+func (m *DeviceMatcher) isEmpty() bool {
+	return m.Bus == nil && m.Device == nil && m.VendorID == nil && m.ProductID == nil &&
+		m.Udev.isEmpty() && m.HostNode == nil && m.Port == nil && m.BehindHub == nil && len(m.Interfaces) == 0 && len(m.Children) == 0 &&
+		len(m.Sysfs.Attr) == 0 && len(m.Sysfs.Attrs) == 0 &&
+		m.All == nil && m.Any == nil && m.Not == nil
 }
 
+// addSysfsAttrs adds the names of all sysfs attributes used by the matcher to the selection.
+// Interfaces and child devices are selected if the matcher looks at them.
+func (m *DeviceMatcher) addSysfsAttrs(attrs *sysfsAttrSelection) {
+	if len(m.Interfaces) > 0 || len(m.Children) > 0 {
+		attrs.children = true
+	}
+	for _, attr := range m.Sysfs.Attr {
+		attrs.add(&attrs.device, attr.Name)
+	}
+	for _, attr := range m.Sysfs.Attrs {
+		attrs.add(&attrs.device, attr.Name)
+		attrs.add(&attrs.parents, attr.Name)
+	}
+	for i := range m.All {
+		m.All[i].addSysfsAttrs(attrs)
+	}
+	for i := range m.Any {
+		m.Any[i].addSysfsAttrs(attrs)
+	}
+	if m.Not != nil {
+		m.Not.addSysfsAttrs(attrs)
+	}
+}
+
+// onlyBusAndDevice returns true if the matcher, including its nested matchers, uses the bus
+// and device numbers but nothing else to identify a device
+func (m *DeviceMatcher) onlyBusAndDevice() bool {
+	return m.usesBusOrDevice() && !m.identifiesDevice()
+}
+
+func (m *DeviceMatcher) usesBusOrDevice() bool {
+	if m.Bus != nil || m.Device != nil {
+		return true
+	}
+	if m.Not != nil && m.Not.usesBusOrDevice() {
+		return true
+	}
+	return slices.ContainsFunc(m.All, func(n DeviceMatcher) bool { return n.usesBusOrDevice() }) ||
+		slices.ContainsFunc(m.Any, func(n DeviceMatcher) bool { return n.usesBusOrDevice() })
+}
+
+// serialNames are the udev properties and sysfs attributes holding the serial number of a device
+var serialNames = []string{"ID_SERIAL", "ID_SERIAL_SHORT", "serial"}
+
+// identifiesSingleDevice returns true if all conditions of the matcher, including its nested
+// 'all' matchers, compare exact single values: ids, serial numbers, the port or the host node.
+// Any other condition, i.e. behind-hub, interfaces or patterns, may match more than one device.
+func (m *DeviceMatcher) identifiesSingleDevice() bool {
+	if m.BehindHub != nil || len(m.Interfaces) > 0 || len(m.Children) > 0 || len(m.Sysfs.Attrs) > 0 ||
+		len(m.Udev.Tags) > 0 || len(m.Udev.CurrentTags) > 0 || len(m.Udev.Symlinks) > 0 ||
+		m.Any != nil || m.Not != nil {
+		return false
+	}
+	for _, set := range []NumberSet{m.VendorID, m.ProductID, m.Bus, m.Device} {
+		if set != nil && !set.isSingle() {
+			return false
+		}
+	}
+	for _, value := range slices.Concat(m.Udev.Env, m.Sysfs.Attr) {
+		if value.Equals == nil || !slices.Contains(serialNames, value.Name) {
+			return false
+		}
+	}
+	return !slices.ContainsFunc(m.All, func(n DeviceMatcher) bool { return !n.identifiesSingleDevice() })
+}
+
+// identifiesDevice returns true if the matcher requires some condition other than the bus and
+// device numbers to hold. A negated condition does not identify a device.
+func (m *DeviceMatcher) identifiesDevice() bool {
+	rest := *m
+	rest.Bus, rest.Device, rest.All, rest.Any, rest.Not = nil, nil, nil, nil, nil
+	if !rest.isEmpty() {
+		return true
+	}
+	if slices.ContainsFunc(m.All, func(n DeviceMatcher) bool { return n.identifiesDevice() }) {
+		return true
+	}
+	return len(m.Any) > 0 && !slices.ContainsFunc(m.Any, func(n DeviceMatcher) bool { return !n.identifiesDevice() })
+}
+
+// initialize validates the matcher and all of its nested matchers. The owner and path are used
+// to point to the offending matcher in error messages, i.e. 'machine foo' and '0.any[1].not'.
+func (m *DeviceMatcher) initialize(owner, path string) error {
+	if m.isEmpty() {
+		return fmt.Errorf("device matcher %s of %s: empty matcher is not allowed", path, owner)
+	}
+	if err := m.Udev.initialize(); err != nil {
+		return fmt.Errorf("device matcher %s of %s: %v", path, owner, err)
+	}
+	numbers := []struct {
+		name     string
+		set      NumberSet
+		min, max int64
+	}{
+		{"bus", m.Bus, 0, math.MaxInt32},
+		{"device", m.Device, 0, math.MaxInt32},
+		{"vendor-id", m.VendorID, 0, math.MaxUint16},
+		{"product-id", m.ProductID, 0, math.MaxUint16},
+	}
+	for _, number := range numbers {
+		if number.set == nil {
+			continue
+		}
+		if err := number.set.validate(number.min, number.max); err != nil {
+			return fmt.Errorf("device matcher %s of %s: %s %v", path, owner, number.name, err)
+		}
+	}
+	if m.HostNode != nil && !filepath.IsAbs(*m.HostNode) {
+		return fmt.Errorf("device matcher %s of %s: host-node must be an absolute path", path, owner)
+	}
+	if m.Port != nil && !usbPortRe.MatchString(*m.Port) {
+		return fmt.Errorf("device matcher %s of %s: invalid port '%s', must look like '3-6.3'", path, owner, *m.Port)
+	}
+	if m.BehindHub != nil && !usbHubRe.MatchString(*m.BehindHub) {
+		return fmt.Errorf("device matcher %s of %s: invalid hub '%s', must look like '3-6' or 'usb3'", path, owner, *m.BehindHub)
+	}
+	for i, intf := range m.Interfaces {
+		if intf.Class == nil && intf.SubClass == nil && intf.Protocol == nil {
+			return fmt.Errorf("device matcher %s of %s: interfaces[%d] must not be empty", path, owner, i)
+		}
+	}
+	for i := range m.Children {
+		child := &m.Children[i]
+		if child.Subsystem == nil && child.Udev.isEmpty() {
+			return fmt.Errorf("device matcher %s of %s: children[%d] must not be empty", path, owner, i)
+		}
+		if err := child.Udev.initialize(); err != nil {
+			return fmt.Errorf("device matcher %s of %s: children[%d]: %v", path, owner, i, err)
+		}
+	}
+	for i := range m.Sysfs.Attr {
+		if err := m.Sysfs.Attr[i].initialize("sysfs attr"); err != nil {
+			return fmt.Errorf("device matcher %s of %s: %v", path, owner, err)
+		}
+	}
+	for i := range m.Sysfs.Attrs {
+		if err := m.Sysfs.Attrs[i].initialize("sysfs attrs"); err != nil {
+			return fmt.Errorf("device matcher %s of %s: %v", path, owner, err)
+		}
+	}
+
+	if m.All != nil && len(m.All) == 0 {
+		return fmt.Errorf("device matcher %s of %s: 'all' must not be empty", path, owner)
+	}
+	for i := range m.All {
+		if err := m.All[i].initialize(owner, fmt.Sprintf("%s.all[%d]", path, i)); err != nil {
+			return err
+		}
+	}
+	if m.Any != nil && len(m.Any) == 0 {
+		return fmt.Errorf("device matcher %s of %s: 'any' must not be empty", path, owner)
+	}
+	for i := range m.Any {
+		if err := m.Any[i].initialize(owner, fmt.Sprintf("%s.any[%d]", path, i)); err != nil {
+			return err
+		}
+	}
+	if m.Not != nil {
+		if err := m.Not.initialize(owner, path+".not"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+const (
+	persistenceLive       = "live"
+	persistenceLiveConfig = "live+config"
+)
+
 type MachineConfig struct {
+	Domain         string          `yaml:"domain"`
+	LibvirtURI     string          `yaml:"libvirt-uri"`
+	Priority       int             `yaml:"priority"`
+	Persistence    string          `yaml:"persistence"`
 	DeviceMatchers []DeviceMatcher `yaml:"devices"`
+	Exclude        []DeviceMatcher `yaml:"exclude"`
+}
+
+func matchesAny(device Device, matchers []DeviceMatcher) bool {
+	return slices.ContainsFunc(matchers, device.Matches)
+}
+
+// Matches returns true if the device is matched by one of the device matchers and not excluded
+func (mconf MachineConfig) Matches(device Device) bool {
+	return matchesAny(device, mconf.DeviceMatchers) && !mconf.Excludes(device)
+}
+
+func (mconf MachineConfig) Excludes(device Device) bool {
+	return matchesAny(device, mconf.Exclude)
+}
+
+// Key uniquely identifies the libvirt domain of the machine across all libvirt connections
+func (mconf MachineConfig) Key() string {
+	return fmt.Sprintf("%s@%s", mconf.Domain, mconf.LibvirtURI)
 }
 
 type Config struct {
-	Interval time.Duration            `yaml:"interval"`
-	Machines map[string]MachineConfig `yaml:"machines"`
+	Interval       time.Duration            `yaml:"interval"`
+	UeventSource   string                   `yaml:"uevent-source"`
+	USBBackend     string                   `yaml:"usb-backend"`
+	Sysroot        string                   `yaml:"sysroot"`
+	DeviceSnapshot string                   `yaml:"device-snapshot"`
+	LibvirtURI     string                   `yaml:"libvirt-uri"`
+	NeverAttach    []DeviceMatcher          `yaml:"never-attach"`
+	Machines       map[string]MachineConfig `yaml:"machines"`
+	Control        ControlConfig            `yaml:"control"`
+
+	// shadowed contains the machines of the main config file which have been replaced
+	// by a snippet in the machines.d directory
+	shadowed []string
+	// defaultInterval is set if the interval has not been configured
+	defaultInterval bool
+}
+
+// intervalWithoutUevents is the default interval if no uevents are received
+const intervalWithoutUevents = 5 * time.Second
+
+// scanInterval returns the interval of the periodic scans. Unless the interval has been
+// configured, it is shortened if uevents are not received because monitor is nil.
+func (conf *Config) scanInterval(monitor *UeventMonitor) time.Duration {
+	if conf.defaultInterval && monitor == nil {
+		return intervalWithoutUevents
+	}
+	return conf.Interval
+}
+
+// NeverAttaches returns true if the device must not be attached to any machine
+func (conf *Config) NeverAttaches(device Device) bool {
+	return matchesAny(device, conf.NeverAttach)
 }
 
 func (conf *Config) loadMachineConfigFromFile(filename string) error {
@@ -86,17 +775,26 @@ func (conf *Config) loadMachineConfigFromFile(filename string) error {
 	}
 	if _, exists := conf.Machines[mname]; exists {
 		wl.Printf("machine '%s' has been found in the global config file as well as in machines.d directory. The latter takes precedence", mname)
+		conf.shadowed = append(conf.shadowed, mname)
 	}
 	conf.Machines[mname] = *mconf
 	return nil
 }
 
-func (conf *Config) loadMachinesConfigFromDirectory(configfile string) error {
+// machinesDirectory returns the path of the machines.d directory which belongs to configfile
+func machinesDirectory(configfile string) (string, error) {
 	path, err := filepath.Abs(configfile)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(filepath.Dir(path), "machines.d"), nil
+}
+
+func (conf *Config) loadMachinesConfigFromDirectory(configfile string) error {
+	machinesDir, err := machinesDirectory(configfile)
 	if err != nil {
 		return err
 	}
-	machinesDir := filepath.Join(filepath.Dir(path), "machines.d")
 	info, err := os.Stat(machinesDir)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -130,44 +828,187 @@ func (conf *Config) loadMachinesConfigFromDirectory(configfile string) error {
 }
 
 func (conf *Config) initialize() error {
+	switch conf.UeventSource {
+	case ueventSourceUdev, ueventSourceKernel, ueventSourceDisabled:
+	default:
+		return fmt.Errorf("invalid uevent-source '%s', must be one of: %s, %s, %s", conf.UeventSource, ueventSourceUdev, ueventSourceKernel, ueventSourceDisabled)
+	}
+	if _, exists := usbEnumerators[conf.USBBackend]; !exists {
+		if conf.USBBackend == usbBackendLibUSB {
+			return fmt.Errorf("usb-backend '%s' is not available, the binary needs to be built with '-tags libusb'", conf.USBBackend)
+		}
+		return fmt.Errorf("invalid usb-backend '%s', must be one of: %s, %s", conf.USBBackend, usbBackendSysfs, usbBackendLibUSB)
+	}
+	if !filepath.IsAbs(conf.Sysroot) {
+		return fmt.Errorf("sysroot '%s' must be an absolute path", conf.Sysroot)
+	}
+	if conf.USBBackend == usbBackendLibUSB && filepath.Clean(conf.Sysroot) != "/" {
+		return fmt.Errorf("usb-backend '%s' does not support a sysroot other than '/'", conf.USBBackend)
+	}
+	if err := conf.Control.initialize(); err != nil {
+		return err
+	}
+	domains := make(map[string]string)
 	for machine, mconf := range conf.Machines {
+		if mconf.Domain == "" {
+			mconf.Domain = machine
+		}
+		if mconf.LibvirtURI == "" {
+			mconf.LibvirtURI = conf.LibvirtURI
+		}
+		switch mconf.Persistence {
+		case "":
+			mconf.Persistence = persistenceLive
+		case persistenceLive, persistenceLiveConfig:
+		default:
+			return fmt.Errorf("machine %s: invalid persistence mode '%s', must be one of: %s, %s", machine, mconf.Persistence, persistenceLive, persistenceLiveConfig)
+		}
+		if _, err := url.Parse(mconf.LibvirtURI); err != nil {
+			return fmt.Errorf("machine %s: invalid libvirt-uri: %v", machine, err)
+		}
+		if other, exists := domains[mconf.Key()]; exists {
+			return fmt.Errorf("machines %s and %s refer to the same libvirt domain %s", other, machine, mconf.Key())
+		}
+		domains[mconf.Key()] = machine
+		conf.Machines[machine] = mconf
+
 		if len(mconf.DeviceMatchers) == 0 {
 			return fmt.Errorf("machine %s has no device matchers", machine)
 		}
-		for idx, matcher := range mconf.DeviceMatchers {
-			if len(matcher.Udev.Env) > 0 {
-				for i, udevEnv := range matcher.Udev.Env {
-					if udevEnv.Name == "" {
-						return fmt.Errorf("device matcher %d of machine %s: udev-env name must not be empty ", idx, machine)
-					}
-					if udevEnv.Equals != nil {
-						if udevEnv.Pattern != nil {
-							return fmt.Errorf("device matcher %d of machine %s: 'equals' and 'pattern' are mutually exclusive ", idx, machine)
-						}
-						continue
-					}
-					if udevEnv.Pattern != nil {
-						re, err := regexp.Compile(*udevEnv.Pattern)
-						if err != nil {
-							return fmt.Errorf("device matcher %d of machine %s: failed to compile pattern: %v", idx, machine, err)
-						}
-						matcher.Udev.Env[i].re = re
-						continue
-					}
-					return fmt.Errorf("device matcher %d of machine %s: udev-env needs at least one of 'equals' or 'pattern'", idx, machine)
-				}
-			} else {
-				if matcher.Bus == nil && matcher.Device == nil && matcher.VendorID == nil && matcher.ProductID == nil && len(matcher.Udev.Tags) == 0 && len(matcher.Udev.CurrentTags) == 0 {
-					return fmt.Errorf("device matcher %d of machine %s: empty matcher is not allowed", idx, machine)
-				}
+		for idx := range mconf.DeviceMatchers {
+			if err := mconf.DeviceMatchers[idx].initialize("machine "+machine, strconv.Itoa(idx)); err != nil {
+				return err
 			}
 		}
+		for idx := range mconf.Exclude {
+			if err := mconf.Exclude[idx].initialize("machine "+machine, fmt.Sprintf("exclude[%d]", idx)); err != nil {
+				return err
+			}
+		}
+	}
+	for idx := range conf.NeverAttach {
+		if err := conf.NeverAttach[idx].initialize("never-attach list", strconv.Itoa(idx)); err != nil {
+			return err
+		}
 	}
 	return nil
 
 }
 
-func readConfig(configfile string) (*Config, error) {
+// sysfsAttrSelection returns the sysfs attributes used by any of the matchers and whether
+// any of them needs the interfaces and child devices
+func (conf *Config) sysfsAttrSelection() (attrs sysfsAttrSelection) {
+	for i := range conf.NeverAttach {
+		conf.NeverAttach[i].addSysfsAttrs(&attrs)
+	}
+	for _, mconf := range conf.Machines {
+		for i := range mconf.DeviceMatchers {
+			mconf.DeviceMatchers[i].addSysfsAttrs(&attrs)
+		}
+		for i := range mconf.Exclude {
+			mconf.Exclude[i].addSysfsAttrs(&attrs)
+		}
+	}
+	return
+}
+
+// LibvirtURIs returns all libvirt URIs used by the configured machines
+func (conf *Config) LibvirtURIs() (uris []string) {
+	for _, mconf := range conf.Machines {
+		if !slices.Contains(uris, mconf.LibvirtURI) {
+			uris = append(uris, mconf.LibvirtURI)
+		}
+	}
+	slices.Sort(uris)
+	return
+}
+
+// sortedMachineNames returns the names of all machines in alphabetical order
+func sortedMachineNames(conf *Config) []string {
+	mnames := make([]string, 0, len(conf.Machines))
+	for mname := range conf.Machines {
+		mnames = append(mnames, mname)
+	}
+	slices.Sort(mnames)
+	return mnames
+}
+
+// MachinesOfLibvirtURI returns the names of all machines using the given libvirt URI
+func (conf *Config) MachinesOfLibvirtURI(uri string) (names []string) {
+	for mname, mconf := range conf.Machines {
+		if mconf.LibvirtURI == uri {
+			names = append(names, mname)
+		}
+	}
+	return
+}
+
+// MachineByDomain returns the name of the machine which refers to the given libvirt domain
+func (conf *Config) MachineByDomain(uri, domain string) (string, bool) {
+	for mname, mconf := range conf.Machines {
+		if mconf.LibvirtURI == uri && mconf.Domain == domain {
+			return mname, true
+		}
+	}
+	return "", false
+}
+
+// withMachines returns a shallow copy of the config which only contains the given machines
+func (conf *Config) withMachines(names ...string) *Config {
+	c := *conf
+	c.Machines = make(map[string]MachineConfig)
+	for _, name := range names {
+		if mconf, exists := conf.Machines[name]; exists {
+			c.Machines[name] = mconf
+		}
+	}
+	return &c
+}
+
+// ControlConfig configures the control socket of the daemon. The socket is disabled
+// unless a path is set.
+type ControlConfig struct {
+	Socket        string   `yaml:"socket"`
+	Mode          string   `yaml:"mode"`
+	Group         string   `yaml:"group"`
+	AllowedUsers  []string `yaml:"allowed-users"`
+	AllowedGroups []string `yaml:"allowed-groups"`
+
+	mode os.FileMode
+}
+
+func (c *ControlConfig) initialize() error {
+	if c.Socket == "" {
+		return nil
+	}
+	if !filepath.IsAbs(c.Socket) {
+		return fmt.Errorf("control: socket '%s' must be an absolute path", c.Socket)
+	}
+	if c.Mode == "" {
+		c.Mode = "0600"
+	}
+	mode, err := strconv.ParseUint(c.Mode, 8, 32)
+	if err != nil || mode > 0o777 {
+		return fmt.Errorf("control: invalid mode '%s', must be an octal number like 0660", c.Mode)
+	}
+	c.mode = os.FileMode(mode)
+	return nil
+}
+
+func (c ControlConfig) equal(other ControlConfig) bool {
+	return c.Socket == other.Socket && c.Mode == other.Mode && c.Group == other.Group &&
+		slices.Equal(c.AllowedUsers, other.AllowedUsers) && slices.Equal(c.AllowedGroups, other.AllowedGroups)
+}
+
+// ConfigOverrides contains settings passed on the command line. Non-empty values take
+// precedence over the ones from the config file.
+type ConfigOverrides struct {
+	LibvirtURI     string
+	Sysroot        string
+	DeviceSnapshot string
+}
+
+func readConfig(configfile string, overrides ConfigOverrides) (*Config, error) {
 	file, err := os.Open(configfile)
 	if err != nil {
 		return nil, fmt.Errorf("failed to open config file: %s", err)
@@ -181,8 +1022,38 @@ func readConfig(configfile string) (*Config, error) {
 	if err = decoder.Decode(c); err != nil {
 		return nil, fmt.Errorf("failed to parse config file: %s", err)
 	}
+	if overrides.LibvirtURI != "" {
+		c.LibvirtURI = overrides.LibvirtURI
+	}
+	if overrides.Sysroot != "" {
+		c.Sysroot = overrides.Sysroot
+	}
+	if overrides.DeviceSnapshot != "" {
+		c.DeviceSnapshot = overrides.DeviceSnapshot
+	}
+	if c.LibvirtURI == "" {
+		c.LibvirtURI = string(libvirt.QEMUSystem)
+	}
+	if c.UeventSource == "" {
+		c.UeventSource = ueventSourceUdev
+	}
+	if c.USBBackend == "" {
+		c.USBBackend = usbBackendSysfs
+	}
+	if c.Sysroot == "" {
+		c.Sysroot = "/"
+	}
+	if c.Machines == nil {
+		// the main config file may contain no machines at all if they are all in machines.d
+		c.Machines = make(map[string]MachineConfig)
+	}
 	if c.Interval == 0 {
-		c.Interval = 5 * time.Second
+		// with uevents enabled the interval is only a safety net in case we missed some events
+		c.Interval = time.Minute
+		if c.UeventSource == ueventSourceDisabled {
+			c.Interval = intervalWithoutUevents
+		}
+		c.defaultInterval = true
 	}
 	if err = c.loadMachinesConfigFromDirectory(configfile); err != nil {
 		return nil, err
@@ -0,0 +1,305 @@
+//
+// Copyright (c) 2025 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.libvirt-usb-hotplugd nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// parseTestConfig parses the config the same way the daemon does
+func parseTestConfig(t *testing.T, text string) (*Config, error) {
+	t.Helper()
+	configfile := filepath.Join(t.TempDir(), "config.yml")
+	if err := os.WriteFile(configfile, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return readConfig(configfile, ConfigOverrides{})
+}
+
+func readTestConfig(t *testing.T, text string) *Config {
+	t.Helper()
+	conf, err := parseTestConfig(t, text)
+	if err != nil {
+		t.Fatalf("failed to parse config: %v", err)
+	}
+	return conf
+}
+
+func TestDeviceMatcherInitializeErrors(t *testing.T) {
+	tests := []struct {
+		matcher string
+		err     string
+	}{
+		{"{}", "device matcher 0 of machine test: empty matcher is not allowed"},
+		{"all: []", "device matcher 0 of machine test: 'all' must not be empty"},
+		{"any: [{vendor-id: 0x046d}, {not: {}}]", "device matcher 0.any[1].not of machine test: empty matcher is not allowed"},
+		{"not: {all: [{vendor-id: 0x046d}, {any: []}]}", "device matcher 0.not.all[1] of machine test: 'any' must not be empty"},
+		{"udev: {env: [{equals: foo}]}", "device matcher 0 of machine test: udev-env name must not be empty"},
+		{"udev: {env: [{name: ID_SERIAL, equals: foo, pattern: foo}]}", "device matcher 0 of machine test: 'equals' and 'pattern' are mutually exclusive"},
+		{"any: [{udev: {env: [{name: ID_SERIAL, pattern: '('}]}}]", "device matcher 0.any[0] of machine test: failed to compile pattern"},
+	}
+	for _, test := range tests {
+		_, err := parseTestConfig(t, "machines:\n  test:\n    devices:\n    - "+test.matcher+"\n")
+		if err == nil || !strings.Contains(err.Error(), test.err) {
+			t.Errorf("%q: got error %v, want %q", test.matcher, err, test.err)
+		}
+	}
+}
+
+func TestGlobToRegexp(t *testing.T) {
+	tests := []struct {
+		glob      string
+		matches   []string
+		noMatches []string
+	}{
+		{"abc", []string{"abc"}, []string{"ab", "abcd", "xabc"}},
+		{"*", []string{"", "abc", ".hidden", "a/b"}, nil},
+		{"a*c", []string{"ac", "abc", "a/b/c"}, []string{"ab", "cac"}},
+		{"a?c", []string{"abc", "a.c", "a/c"}, []string{"ac", "abbc"}},
+		{"[0-9]*", []string{"0", "1abc"}, []string{"", "a1"}},
+		{"[!0-9]*", []string{"a", "a1"}, []string{"0", "1abc"}},
+		{"[^0-9]", []string{"a"}, []string{"0"}},
+		{"[]]", []string{"]"}, []string{"[", "a"}},
+		{"[!]]", []string{"a"}, []string{"]"}},
+		{"[a^]", []string{"a", "^"}, []string{"b"}},
+		{"[\\]", []string{"\\"}, []string{"a"}},
+		{"\\*", []string{"*"}, []string{"a"}},
+		{"a.c", []string{"a.c"}, []string{"abc"}},
+		{"(x)+|y", []string{"(x)+|y"}, []string{"x", "y"}},
+		{"Logitech_*_[0-9A-F]???", []string{"Logitech_Webcam_C270_A1B2"}, []string{"Logitech_Webcam_C270_a1b2"}},
+	}
+	for _, test := range tests {
+		re, err := globToRegexp(test.glob)
+		if err != nil {
+			t.Errorf("glob %q: unexpected error: %v", test.glob, err)
+			continue
+		}
+		for _, s := range test.matches {
+			if !re.MatchString(s) {
+				t.Errorf("glob %q should match %q (regexp: %s)", test.glob, s, re)
+			}
+		}
+		for _, s := range test.noMatches {
+			if re.MatchString(s) {
+				t.Errorf("glob %q should not match %q (regexp: %s)", test.glob, s, re)
+			}
+		}
+	}
+}
+
+func TestGlobToRegexpInvalid(t *testing.T) {
+	for _, glob := range []string{"abc\\", "[abc", "[!", "[]"} {
+		if _, err := globToRegexp(glob); err == nil {
+			t.Errorf("glob %q: expected an error", glob)
+		}
+	}
+}
+
+// testValueMatcher returns the initialized value matcher given in yaml
+func testValueMatcher(text string) (v ValueMatcher, err error) {
+	if err = yaml.Unmarshal([]byte(text), &v); err != nil {
+		return
+	}
+	err = v.initialize("udev-env")
+	return
+}
+
+func TestValueMatcher(t *testing.T) {
+	values := map[string]string{
+		"ID_SERIAL": "Logitech_C270",
+		"speed":     "480",
+		"bcdDevice": "0x0010",
+		"bMaxPower": " 500",
+		"idProduct": "1f",
+	}
+	tests := []struct {
+		matcher  string
+		expected bool
+	}{
+		{"{name: ID_SERIAL, equals: Logitech_C270}", true},
+		{"{name: ID_SERIAL, equals: logitech_c270}", false},
+		{"{name: ID_SERIAL, equals-ignore-case: logitech_c270}", true},
+		{"{name: ID_SERIAL, one-of: [foo, Logitech_C270]}", true},
+		{"{name: ID_SERIAL, one-of: [foo, bar]}", false},
+		{"{name: ID_SERIAL, pattern: '^Logi'}", true},
+		{"{name: ID_SERIAL, pattern: '^C270'}", false},
+		{"{name: ID_SERIAL, glob: 'Logi*'}", true},
+		{"{name: ID_SERIAL, glob: 'logi*'}", false},
+		{"{name: ID_SERIAL, exists: true}", true},
+		{"{name: ID_SERIAL, exists: false}", false},
+		{"{name: MISSING, exists: false}", true},
+		{"{name: MISSING, absent: true}", true},
+		{"{name: ID_SERIAL, absent: true}", false},
+		{"{name: ID_SERIAL, absent: false}", true},
+		{"{name: MISSING, equals: ''}", false},
+		{"{name: MISSING, min: 0}", false},
+		{"{name: speed, min: 480}", true},
+		{"{name: speed, min: 481}", false},
+		{"{name: speed, max: 480}", true},
+		{"{name: speed, min: 12, max: 479}", false},
+		{"{name: bMaxPower, min: 100, max: 500}", true},
+		{"{name: bcdDevice, min: 16, max: 16}", true},
+		{"{name: idProduct, min: 0x1f, max: 0x1f, base: 16}", true},
+		{"{name: idProduct, min: 0, base: 10}", false},
+		{"{name: idProduct, min: 0}", false},
+		{"{name: ID_SERIAL, min: 0}", false},
+	}
+	for _, test := range tests {
+		v, err := testValueMatcher(test.matcher)
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.matcher, err)
+			continue
+		}
+		if got := v.Matches(values); got != test.expected {
+			t.Errorf("%q: got %t, want %t", test.matcher, got, test.expected)
+		}
+	}
+}
+
+func TestValueMatcherInitialize(t *testing.T) {
+	tests := []struct {
+		matcher string
+		err     string
+	}{
+		{"{name: ID_SERIAL, min: 1, max: 2}", ""},
+		{"{name: ID_SERIAL, min: 0x10, base: 16}", ""},
+		{"{equals: foo}", "udev-env name must not be empty"},
+		{"{name: ID_SERIAL}", "udev-env needs at least one of"},
+		{"{name: ID_SERIAL, equals: foo, glob: foo}", "'equals' and 'glob' are mutually exclusive"},
+		{"{name: ID_SERIAL, exists: true, absent: false}", "'exists' and 'absent' are mutually exclusive"},
+		{"{name: ID_SERIAL, one-of: []}", "'one-of' must not be empty"},
+		{"{name: ID_SERIAL, pattern: '('}", "failed to compile pattern"},
+		{"{name: ID_SERIAL, glob: '[a'}", "invalid glob"},
+		{"{name: ID_SERIAL, min: 2, max: 1}", "'min' must not be greater than 'max'"},
+		{"{name: ID_SERIAL, equals: foo, base: 16}", "'base' is only allowed together with 'min' or 'max'"},
+		{"{name: ID_SERIAL, min: 1, base: 8}", "'base' must be either 10 or 16"},
+	}
+	for _, test := range tests {
+		_, err := testValueMatcher(test.matcher)
+		switch {
+		case test.err == "" && err != nil:
+			t.Errorf("%q: unexpected error: %v", test.matcher, err)
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%q: got error %v, want %q", test.matcher, err, test.err)
+		}
+	}
+}
+
+func TestNumberSetUnmarshal(t *testing.T) {
+	tests := []struct {
+		yaml     string
+		expected NumberSet
+		err      bool
+	}{
+		{yaml: "3", expected: NumberSet{{3, 3}}},
+		{yaml: "0x046d", expected: NumberSet{{0x046d, 0x046d}}},
+		{yaml: "'0x046D'", expected: NumberSet{{0x046d, 0x046d}}},
+		{yaml: "1-4", expected: NumberSet{{1, 4}}},
+		{yaml: "0x1f00-0x1fff", expected: NumberSet{{0x1f00, 0x1fff}}},
+		{yaml: "0x10 - 32", expected: NumberSet{{16, 32}}},
+		{yaml: "[1, 3-5, 0x10]", expected: NumberSet{{1, 1}, {3, 5}, {16, 16}}},
+		{yaml: "- 0x046d\n- 0x1050-0x1051\n", expected: NumberSet{{0x046d, 0x046d}, {0x1050, 0x1051}}},
+		{yaml: "[]", expected: NumberSet{}},
+		{yaml: "5-3", err: true},
+		{yaml: "abc", err: true},
+		{yaml: "1-", err: true},
+		{yaml: "0xg", err: true},
+		{yaml: "[1, [2]]", err: true},
+		{yaml: "{a: 1}", err: true},
+	}
+	for _, test := range tests {
+		var set NumberSet
+		err := yaml.Unmarshal([]byte(test.yaml), &set)
+		if test.err {
+			if err == nil {
+				t.Errorf("%q: expected an error, got %v", test.yaml, set)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error: %v", test.yaml, err)
+			continue
+		}
+		if !slices.Equal(set, test.expected) {
+			t.Errorf("%q: got %v, want %v", test.yaml, set, test.expected)
+		}
+	}
+}
+
+func TestNumberSetContains(t *testing.T) {
+	set := NumberSet{{1, 1}, {3, 5}}
+	tests := []struct {
+		n        int64
+		expected bool
+	}{
+		{0, false},
+		{1, true},
+		{2, false},
+		{3, true},
+		{4, true},
+		{5, true},
+		{6, false},
+	}
+	for _, test := range tests {
+		if got := set.Contains(test.n); got != test.expected {
+			t.Errorf("%v contains %d: got %t, want %t", set, test.n, got, test.expected)
+		}
+	}
+}
+
+func TestScanInterval(t *testing.T) {
+	tests := []struct {
+		config      string
+		withUevents time.Duration
+		without     time.Duration
+	}{
+		{"machines: {}", time.Minute, 5 * time.Second},
+		{"uevent-source: disabled", 5 * time.Second, 5 * time.Second},
+		{"interval: 2m", 2 * time.Minute, 2 * time.Minute},
+		{"{interval: 30s, uevent-source: disabled}", 30 * time.Second, 30 * time.Second},
+	}
+	for _, test := range tests {
+		conf := readTestConfig(t, test.config)
+		if got := conf.scanInterval(&UeventMonitor{}); got != test.withUevents {
+			t.Errorf("%q: got interval %v with uevents, want %v", test.config, got, test.withUevents)
+		}
+		if got := conf.scanInterval(nil); got != test.without {
+			t.Errorf("%q: got interval %v without uevents, want %v", test.config, got, test.without)
+		}
+	}
+}
@@ -0,0 +1,470 @@
+//
+// Copyright (c) 2025 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.libvirt-usb-hotplugd nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"os/user"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+type ControlRequestType string
+
+const (
+	ControlStatus    ControlRequestType = "status"
+	ControlReconcile ControlRequestType = "reconcile"
+	ControlReload    ControlRequestType = "reload"
+	ControlPause     ControlRequestType = "pause"
+	ControlResume    ControlRequestType = "resume"
+)
+
+// statusMaxAge is how long the result of Status is reused, this way clients polling the
+// status can't keep the daemon busy listing devices and machines
+const statusMaxAge = 5 * time.Second
+
+// ErrReconcilePaused is returned for reconcile requests while reconciliation is paused
+var ErrReconcilePaused = errors.New("reconciliation is paused")
+
+// ControlRequest is sent to the daemon for every API call. The daemon must send exactly
+// one response to Reply, Status is only needed for status requests.
+type ControlRequest struct {
+	Type  ControlRequestType
+	Reply chan<- ControlResponse
+}
+
+type ControlResponse struct {
+	Status *Status
+	Err    error
+}
+
+// DeviceStatus describes a device connected to the host
+type DeviceStatus struct {
+	Slug        string   `json:"slug"`
+	Device      string   `json:"device"`
+	NeverAttach bool     `json:"never-attach,omitempty"`
+	MatchedBy   []string `json:"matched-by"`
+	AttachedTo  []string `json:"attached-to"`
+}
+
+// MachineStatus describes a configured machine
+type MachineStatus struct {
+	Name       string `json:"name"`
+	Key        string `json:"key"`
+	LibvirtURI string `json:"libvirt-uri"`
+	Connected  bool   `json:"connected"`
+	Running    bool   `json:"running"`
+	// MatchedDevices are the connected devices which match the machine
+	MatchedDevices []string `json:"matched-devices"`
+	// AttachedDevices are the devices attached to the running machine by the daemon
+	AttachedDevices []string `json:"attached-devices"`
+	// StaticDevices are USB hostdevs of the running machine which have not been attached by the daemon
+	StaticDevices []string `json:"static-devices,omitempty"`
+}
+
+// Status is the current state of the daemon as seen by the control socket
+type Status struct {
+	Version    string `json:"version"`
+	ConfigFile string `json:"config-file"`
+	Paused     bool   `json:"paused"`
+	DryRun     bool   `json:"dry-run"`
+	// Updated is the time at which the devices and machines have been listed
+	Updated time.Time `json:"updated"`
+	// LastReconcile is the time of the last reconciliation pass, LastErrors contains its errors
+	LastReconcile *time.Time `json:"last-reconcile,omitempty"`
+	LastErrors    []string   `json:"last-errors,omitempty"`
+	// Error is set if the current state could not be determined
+	Error     string          `json:"error,omitempty"`
+	Devices   []DeviceStatus  `json:"devices"`
+	Machines  []MachineStatus `json:"machines"`
+	Conflicts []Conflict      `json:"conflicts"`
+	// PendingActions are the attach and detach actions the next reconciliation pass would apply
+	PendingActions []Action `json:"pending-actions"`
+}
+
+func errorStrings(err error) []string {
+	if err == nil {
+		return nil
+	}
+	if joined, ok := err.(interface{ Unwrap() []error }); ok {
+		var strs []string
+		for _, e := range joined.Unwrap() {
+			strs = append(strs, errorStrings(e)...)
+		}
+		return strs
+	}
+	return []string{err.Error()}
+}
+
+func deviceStrings(devices map[string]Device) []string {
+	strs := []string{}
+	for _, slug := range sortedDeviceSlugs(devices) {
+		device := devices[slug]
+		strs = append(strs, device.String())
+	}
+	return strs
+}
+
+// Status returns the current state of all devices and machines without modifying anything.
+// The devices and machines are only listed again if the configuration has changed, there
+// has been a reconciliation pass or the last result is older than statusMaxAge.
+func (r *Reconciler) Status(conf *Config) *Status {
+	if r.status == nil || r.statusConf != conf || time.Since(r.status.Updated) > statusMaxAge {
+		r.status, r.statusConf = r.listStatus(conf), conf
+	}
+	status := *r.status
+	status.DryRun = r.DryRun
+	status.Conflicts = r.Conflicts()
+	if lastRun, lastErr := r.LastRun(); !lastRun.IsZero() {
+		status.LastReconcile = &lastRun
+		status.LastErrors = errorStrings(lastErr)
+	}
+	return &status
+}
+
+func (r *Reconciler) listStatus(conf *Config) *Status {
+	status := &Status{Version: versionString(), Updated: time.Now(), Devices: []DeviceStatus{}, Machines: []MachineStatus{}, PendingActions: []Action{}}
+	plan, err := r.Plan(conf)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+	if len(plan.errs) > 0 {
+		status.Error = errors.Join(plan.errs...).Error()
+	}
+
+	for _, slug := range sortedDeviceSlugs(plan.devices) {
+		device := plan.devices[slug]
+		ds := DeviceStatus{Slug: slug, Device: device.String(), NeverAttach: conf.NeverAttaches(device), MatchedBy: machineKeys(conf, plan.candidates[slug]), AttachedTo: []string{}}
+		for _, mname := range sortedMachineNames(conf) {
+			if machine, running := plan.machines[mname]; running {
+				if _, attached := machine.Devices[slug]; attached {
+					ds.AttachedTo = append(ds.AttachedTo, machine.Key())
+				}
+			}
+		}
+		status.Devices = append(status.Devices, ds)
+	}
+	for _, mname := range sortedMachineNames(conf) {
+		mconf := conf.Machines[mname]
+		ms := MachineStatus{Name: mname, Key: mconf.Key(), LibvirtURI: mconf.LibvirtURI, MatchedDevices: []string{}, AttachedDevices: []string{}}
+		_, err := r.conns.Get(mconf.LibvirtURI)
+		ms.Connected = err == nil
+		for _, slug := range sortedDeviceSlugs(plan.devices) {
+			if device := plan.devices[slug]; slices.Contains(plan.candidates[slug], mname) {
+				ms.MatchedDevices = append(ms.MatchedDevices, device.String())
+			}
+		}
+		if machine, running := plan.machines[mname]; running {
+			ms.Running = true
+			ms.AttachedDevices = deviceStrings(machine.Devices)
+			if len(machine.StaticDevices) > 0 {
+				ms.StaticDevices = deviceStrings(machine.StaticDevices)
+			}
+		}
+		status.Machines = append(status.Machines, ms)
+	}
+	for _, action := range plan.Actions {
+		if action.Type == ActionAttach || action.Type == ActionDetach {
+			status.PendingActions = append(status.PendingActions, action)
+		}
+	}
+	return status
+}
+
+// lookupID resolves a user or group name, numeric IDs are used as is
+func lookupID(name string, lookup func(string) (string, error)) (uint32, error) {
+	if id, err := strconv.ParseUint(name, 10, 32); err == nil {
+		return uint32(id), nil
+	}
+	idstr, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	id, err := strconv.ParseUint(idstr, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid id '%s' of '%s': %v", idstr, name, err)
+	}
+	return uint32(id), nil
+}
+
+func lookupUID(name string) (uint32, error) {
+	return lookupID(name, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+}
+
+func lookupGID(name string) (uint32, error) {
+	return lookupID(name, func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	})
+}
+
+// controlAccess decides which peers may use the control socket. root and the user running
+// the daemon are always allowed.
+type controlAccess struct {
+	uids []uint32
+	gids []uint32
+}
+
+func newControlAccess(conf ControlConfig) (*controlAccess, error) {
+	a := &controlAccess{uids: []uint32{0, uint32(os.Getuid())}}
+	for _, name := range conf.AllowedUsers {
+		uid, err := lookupUID(name)
+		if err != nil {
+			return nil, fmt.Errorf("control: invalid allowed user '%s': %v", name, err)
+		}
+		a.uids = append(a.uids, uid)
+	}
+	for _, name := range conf.AllowedGroups {
+		gid, err := lookupGID(name)
+		if err != nil {
+			return nil, fmt.Errorf("control: invalid allowed group '%s': %v", name, err)
+		}
+		a.gids = append(a.gids, gid)
+	}
+	return a, nil
+}
+
+// allowed checks the credentials of the peer, besides the primary group of the peer process
+// the supplementary groups of the user are taken into account.
+func (a *controlAccess) allowed(cred *unix.Ucred) bool {
+	if slices.Contains(a.uids, cred.Uid) || slices.Contains(a.gids, cred.Gid) {
+		return true
+	}
+	if len(a.gids) == 0 {
+		return false
+	}
+	u, err := user.LookupId(strconv.FormatUint(uint64(cred.Uid), 10))
+	if err != nil {
+		return false
+	}
+	gids, err := u.GroupIds()
+	if err != nil {
+		return false
+	}
+	for _, gidstr := range gids {
+		if gid, err := strconv.ParseUint(gidstr, 10, 32); err == nil && slices.Contains(a.gids, uint32(gid)) {
+			return true
+		}
+	}
+	return false
+}
+
+func peerCredentials(conn net.Conn) (*unix.Ucred, error) {
+	uconn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil, fmt.Errorf("not a unix socket connection")
+	}
+	raw, err := uconn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+	var cred *unix.Ucred
+	var credErr error
+	if err = raw.Control(func(fd uintptr) {
+		cred, credErr = unix.GetsockoptUcred(int(fd), unix.SOL_SOCKET, unix.SO_PEERCRED)
+	}); err != nil {
+		return nil, err
+	}
+	return cred, credErr
+}
+
+type peerCredentialsKey struct{}
+
+// ControlServer serves the HTTP+JSON API on the control socket. All requests are forwarded
+// to the daemon using a channel so the daemon stays in charge of the configuration and the
+// reconciler.
+type ControlServer struct {
+	listener net.Listener
+	server   *http.Server
+	access   *controlAccess
+	requests chan<- ControlRequest
+}
+
+func listenControlSocket(conf ControlConfig) (net.Listener, error) {
+	// remove a stale socket of a previous instance, refuse to remove anything else
+	if info, err := os.Lstat(conf.Socket); err == nil {
+		if info.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("'%s' exists and is not a socket", conf.Socket)
+		}
+		conn, err := net.DialTimeout("unix", conf.Socket, time.Second)
+		if err == nil {
+			conn.Close() //nolint:errcheck
+			return nil, fmt.Errorf("'%s' is in use by another process", conf.Socket)
+		}
+		if !errors.Is(err, unix.ECONNREFUSED) {
+			return nil, fmt.Errorf("failed to check whether '%s' is in use: %v", conf.Socket, err)
+		}
+		if err = os.Remove(conf.Socket); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %v", err)
+		}
+	}
+	// the socket must not be accessible before the permissions are set
+	oldmask := unix.Umask(0o777)
+	listener, err := net.Listen("unix", conf.Socket)
+	unix.Umask(oldmask)
+	if err != nil {
+		return nil, err
+	}
+	if conf.Group != "" {
+		gid, err := lookupGID(conf.Group)
+		if err != nil {
+			listener.Close() //nolint:errcheck
+			return nil, fmt.Errorf("invalid group '%s': %v", conf.Group, err)
+		}
+		if err = os.Chown(conf.Socket, -1, int(gid)); err != nil {
+			listener.Close() //nolint:errcheck
+			return nil, err
+		}
+	}
+	if err = os.Chmod(conf.Socket, conf.mode); err != nil {
+		listener.Close() //nolint:errcheck
+		return nil, err
+	}
+	return listener, nil
+}
+
+func NewControlServer(conf ControlConfig, requests chan<- ControlRequest) (*ControlServer, error) {
+	access, err := newControlAccess(conf)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := listenControlSocket(conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create control socket: %v", err)
+	}
+	s := &ControlServer{listener: listener, access: access, requests: requests}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/status", s.handle(ControlStatus))
+	for _, t := range []ControlRequestType{ControlReconcile, ControlReload, ControlPause, ControlResume} {
+		mux.HandleFunc("POST /v1/"+string(t), s.handle(t))
+	}
+	s.server = &http.Server{
+		Handler:           s.authorize(mux),
+		ReadHeaderTimeout: 10 * time.Second,
+		ConnContext: func(ctx context.Context, conn net.Conn) context.Context {
+			cred, err := peerCredentials(conn)
+			if err != nil {
+				wl.Printf("control: failed to get credentials of peer: %v", err)
+				return ctx
+			}
+			return context.WithValue(ctx, peerCredentialsKey{}, cred)
+		},
+	}
+	return s, nil
+}
+
+func writeJSON(w http.ResponseWriter, code int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v) //nolint:errcheck
+}
+
+type controlResult struct {
+	Result string `json:"result,omitempty"`
+	Error  string `json:"error,omitempty"`
+}
+
+func (s *ControlServer) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cred, _ := r.Context().Value(peerCredentialsKey{}).(*unix.Ucred)
+		if cred == nil || !s.access.allowed(cred) {
+			if cred != nil {
+				wl.Printf("control: denied %s %s for uid=%d gid=%d pid=%d", r.Method, r.URL.Path, cred.Uid, cred.Gid, cred.Pid)
+			}
+			writeJSON(w, http.StatusForbidden, controlResult{Error: "access denied"})
+			return
+		}
+		wdl.Printf("control: %s %s by uid=%d pid=%d", r.Method, r.URL.Path, cred.Uid, cred.Pid)
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *ControlServer) handle(t ControlRequestType) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		reply := make(chan ControlResponse, 1)
+		select {
+		case s.requests <- ControlRequest{Type: t, Reply: reply}:
+		case <-r.Context().Done():
+			return
+		}
+		var resp ControlResponse
+		select {
+		case resp = <-reply:
+		case <-r.Context().Done():
+			return
+		}
+		switch {
+		case errors.Is(resp.Err, ErrReconcilePaused):
+			writeJSON(w, http.StatusConflict, controlResult{Error: resp.Err.Error()})
+		case resp.Err != nil:
+			writeJSON(w, http.StatusInternalServerError, controlResult{Error: strings.Join(errorStrings(resp.Err), "\n")})
+		case t == ControlStatus:
+			writeJSON(w, http.StatusOK, resp.Status)
+		default:
+			writeJSON(w, http.StatusOK, controlResult{Result: "ok"})
+		}
+	}
+}
+
+// Run serves requests until the server has been closed
+func (s *ControlServer) Run() {
+	if err := s.server.Serve(s.listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		wl.Printf("control: failed to serve requests: %v", err)
+	}
+}
+
+// Close stops the server and removes the socket. Pending requests are aborted.
+func (s *ControlServer) Close() error {
+	return s.server.Close()
+}
@@ -0,0 +1,79 @@
+//
+// Copyright (c) 2025 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.libvirt-usb-hotplugd nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"os"
+	"os/user"
+	"strconv"
+	"testing"
+
+	"golang.org/x/sys/unix"
+)
+
+func TestControlAccessAllowed(t *testing.T) {
+	// the supplementary groups are looked up for the user running the test
+	uid := uint32(os.Getuid())
+	var supplementary []uint32
+	if u, err := user.LookupId(strconv.FormatUint(uint64(uid), 10)); err == nil {
+		if gids, err := u.GroupIds(); err == nil {
+			for _, gidstr := range gids {
+				if gid, err := strconv.ParseUint(gidstr, 10, 32); err == nil && uint32(gid) != uint32(os.Getgid()) {
+					supplementary = append(supplementary, uint32(gid))
+				}
+			}
+		}
+	}
+	const unknownUID = 4000000000
+	const unknownGID = 4000000001
+
+	type accessTest struct {
+		name     string
+		access   controlAccess
+		cred     unix.Ucred
+		expected bool
+	}
+	tests := []accessTest{
+		{"allowed user", controlAccess{uids: []uint32{0, 1000}}, unix.Ucred{Uid: 1000, Gid: 1000}, true},
+		{"other user", controlAccess{uids: []uint32{0, 1000}}, unix.Ucred{Uid: 1001, Gid: 1001}, false},
+		{"allowed primary group", controlAccess{uids: []uint32{0}, gids: []uint32{1001}}, unix.Ucred{Uid: unknownUID, Gid: 1001}, true},
+		{"unknown user in other group", controlAccess{uids: []uint32{0}, gids: []uint32{1001}}, unix.Ucred{Uid: unknownUID, Gid: unknownGID}, false},
+		{"no allowed groups", controlAccess{uids: []uint32{unknownUID}}, unix.Ucred{Uid: uid, Gid: unknownGID}, false},
+	}
+	if len(supplementary) > 0 {
+		tests = append(tests, accessTest{"allowed supplementary group", controlAccess{uids: []uint32{unknownUID}, gids: supplementary[:1]}, unix.Ucred{Uid: uid, Gid: unknownGID}, true})
+	}
+	for _, test := range tests {
+		if got := test.access.allowed(&test.cred); got != test.expected {
+			t.Errorf("%s: got %t, want %t", test.name, got, test.expected)
+		}
+	}
+}
@@ -32,12 +32,12 @@ package main
 
 import (
 	"fmt"
+	"regexp"
 	"slices"
 	"strconv"
 	"strings"
 	"text/template"
 
-	"github.com/Emposat/usb"
 	"github.com/antchfx/xmlquery"
 )
 
@@ -49,36 +49,107 @@ const (
         <product id='{{ printf "0x%04x" .ProductID }}' />
         <address bus='{{ printf "%d" .Bus }}' device='{{ printf "%d" .Device }}' />
       </source>
+      <alias name='{{ .Alias }}' />
     </hostdev>
 `
+
+	// libvirt requires user-defined aliases to start with 'ua-'
+	hostdevAliasPrefix = "ua-hotplugd-"
 )
 
 var (
 	hostdevXMLTemplate = template.Must(template.New("attach-device-xml").Parse(hostdevXMLTemplateText))
 )
 
+type UdevData struct {
+	Env         map[string]string `json:"env"`
+	Tags        []string          `json:"tags,omitempty"`
+	CurrentTags []string          `json:"current-tags,omitempty"`
+	Symlinks    []string          `json:"symlinks,omitempty"`
+}
+
+type USBInterface struct {
+	Number   uint8  `json:"number"`
+	Class    uint8  `json:"class"`
+	SubClass uint8  `json:"sub-class"`
+	Protocol uint8  `json:"protocol"`
+	Driver   string `json:"driver,omitempty"`
+}
+
+// ChildDevice is a device found below an USB device in sysfs, like an USB interface
+// or a tty, input, block or network device
+type ChildDevice struct {
+	Path      string   `json:"path"`
+	Subsystem string   `json:"subsystem,omitempty"`
+	Udev      UdevData `json:"udev"`
+}
+
 type Device struct {
-	VendorID  uint16
-	ProductID uint16
-	Bus       int
-	Device    int
+	VendorID  uint16 `json:"vendor-id"`
+	ProductID uint16 `json:"product-id"`
+	Bus       int    `json:"bus"`
+	Device    int    `json:"device"`
+	// Port is the physical location of the device, i.e. '3-6.3' for port 3 of the hub
+	// connected to port 6 of the root hub of bus 3. This is empty for root hubs.
+	Port string `json:"port,omitempty"`
+	// Hubs contains all hubs the device is connected to starting with the direct parent,
+	// i.e. '3-6' and 'usb3' for the example above.
+	Hubs []string `json:"hubs,omitempty"`
+
+	// VendorName and ProductName are the human readable names of the device, if known
+	VendorName  string `json:"vendor-name,omitempty"`
+	ProductName string `json:"product-name,omitempty"`
 
-	libusb *usb.Device
-	Udev   struct {
-		Env         map[string]string
-		Tags        []string
-		CurrentTags []string
+	Udev       UdevData       `json:"udev"`
+	Interfaces []USBInterface `json:"interfaces,omitempty"`
+	Children   []ChildDevice  `json:"children,omitempty"`
+	Sysfs      struct {
+		SysfsDevice
+		// Parents contains all parent devices starting with the direct parent
+		Parents []SysfsDevice `json:"parents,omitempty"`
+	} `json:"sysfs"`
+}
+
+var (
+	usbPortRe = regexp.MustCompile(`^[0-9]+-[0-9]+(\.[0-9]+)*$`)
+	usbHubRe  = regexp.MustCompile(`^(usb[0-9]+|[0-9]+-[0-9]+(\.[0-9]+)*)$`)
+)
+
+// usbPortHubs returns the hubs in front of the given port starting with the direct parent
+func usbPortHubs(port string) (hubs []string) {
+	for {
+		idx := strings.LastIndex(port, ".")
+		if idx < 0 {
+			break
+		}
+		port = port[:idx]
+		hubs = append(hubs, port)
 	}
+	bus, _, _ := strings.Cut(port, "-")
+	return append(hubs, "usb"+bus)
 }
 
-func NewDeviceFromLibUSB(libusb *usb.Device) (d Device) {
-	d.libusb = libusb
-	d.VendorID = libusb.Vendor.ID
-	d.ProductID = libusb.Product.ID
-	d.Bus = libusb.Bus
-	d.Device = libusb.Device
-	d.Udev.Env = make(map[string]string)
-	return
+// SetPort sets the port of the device based on its sysfs kernel name. If this is not
+// possible, i.e. because the sysfs path is unknown, the udev environment variable
+// ID_PATH is used instead.
+func (d *Device) SetPort(sysfsName string) {
+	d.Port = ""
+	d.Hubs = nil
+	if usbPortRe.MatchString(sysfsName) {
+		d.Port = sysfsName
+	} else if idPath, exists := d.Udev.Env["ID_PATH"]; exists {
+		// ID_PATH looks like 'pci-0000:06:00.3-usb-0:6.3'
+		if idx := strings.LastIndex(idPath, "-usb-"); idx >= 0 {
+			if _, ports, found := strings.Cut(idPath[idx:], ":"); found {
+				if port := fmt.Sprintf("%d-%s", d.Bus, ports); usbPortRe.MatchString(port) {
+					d.Port = port
+				}
+			}
+		}
+	}
+	if d.Port != "" {
+		d.Hubs = usbPortHubs(d.Port)
+	}
 }
 
 func uint16From0xString(str string) (uint16, error) {
@@ -91,6 +162,15 @@ func intFromString(str string) (int, error) {
 	return int(val), err
 }
 
+// IsManagedHostdev returns true if the hostdev has been attached by us
+func IsManagedHostdev(hostdev *xmlquery.Node) bool {
+	alias := hostdev.SelectElement("alias")
+	if alias == nil {
+		return false
+	}
+	return strings.HasPrefix(alias.SelectAttr("name"), hostdevAliasPrefix)
+}
+
 func NewDeviceFromLibVirtHostdev(hostdev *xmlquery.Node) (d Device, err error) {
 	src := hostdev.SelectElement("source")
 	if src == nil {
@@ -103,7 +183,7 @@ func NewDeviceFromLibVirtHostdev(hostdev *xmlquery.Node) (d Device, err error) {
 		return
 	}
 	product := src.SelectElement("product")
-	if vendor == nil {
+	if product == nil {
 		err = fmt.Errorf("hostdev source has no 'product' element")
 		return
 	}
@@ -131,8 +211,8 @@ func NewDeviceFromLibVirtHostdev(hostdev *xmlquery.Node) (d Device, err error) {
 
 func (d *Device) String() string {
 	names := ""
-	if d.libusb != nil {
-		names = " " + d.libusb.Vendor.Name() + " " + d.libusb.Product.Name()
+	if d.VendorName != "" || d.ProductName != "" {
+		names = " " + d.VendorName + " " + d.ProductName
 	}
 	return fmt.Sprintf("Bus %03d Device %03d: %04x:%04x%s", d.Bus, d.Device, d.VendorID, d.ProductID, names)
 }
@@ -141,6 +221,11 @@ func (d *Device) Slug() string {
 	return fmt.Sprintf("%03d/%03d %04x:%04x", d.Bus, d.Device, d.VendorID, d.ProductID)
 }
 
+// Alias is used to mark hostdevs that have been attached by us
+func (d *Device) Alias() string {
+	return fmt.Sprintf("%s%03d-%03d", hostdevAliasPrefix, d.Bus, d.Device)
+}
+
 func (d *Device) HostDevXML() (string, error) {
 	var buf strings.Builder
 	if err := hostdevXMLTemplate.Execute(&buf, d); err != nil {
@@ -149,40 +234,250 @@ func (d *Device) HostDevXML() (string, error) {
 	return buf.String(), nil
 }
 
-func (d *Device) Matches(matcher DeviceMatcher) bool {
-	if matcher.Bus != nil && *matcher.Bus != d.Bus {
+// MatchClause is the result of a single condition of a device matcher
+type MatchClause struct {
+	Clause   string `json:"clause"`
+	Expected string `json:"expected"`
+	Actual   string `json:"actual"`
+	Passed   bool   `json:"passed"`
+	// Nested contains the traces of the matchers of all, any and not
+	Nested []MatchTrace `json:"nested,omitempty"`
+}
+
+// MatchTrace explains why a device matcher did or did not match a device
+type MatchTrace struct {
+	Matched bool          `json:"matched"`
+	Clauses []MatchClause `json:"clauses"`
+}
+
+func (t *MatchTrace) add(clause, expected, actual string, passed bool, nested ...MatchTrace) {
+	t.Clauses = append(t.Clauses, MatchClause{Clause: clause, Expected: expected, Actual: actual, Passed: passed, Nested: nested})
+	t.Matched = t.Matched && passed
+}
+
+func quoteOrUnset(value string, exists bool) string {
+	if !exists {
+		return "<unset>"
+	}
+	return fmt.Sprintf("'%s'", value)
+}
+
+func (intf USBInterface) String() string {
+	return fmt.Sprintf("class=%02x subclass=%02x protocol=%02x", intf.Class, intf.SubClass, intf.Protocol)
+}
+
+// matchWalker evaluates the conditions of a device matcher. Without a trace it stops at the
+// first condition that fails, otherwise all conditions are evaluated and added to the trace.
+type matchWalker struct {
+	trace   *MatchTrace
+	matched bool
+}
+
+// check records the result of a condition, describe is only called if there is a trace. It
+// returns false if the walk can stop because the result is already known.
+func (w *matchWalker) check(clause string, passed bool, describe func() (expected, actual string), nested ...MatchTrace) bool {
+	w.matched = w.matched && passed
+	if w.trace == nil {
+		return w.matched
+	}
+	expected, actual := describe()
+	w.trace.add(clause, expected, actual, passed, nested...)
+	return true
+}
+
+// nested evaluates a nested matcher, its trace is only returned if the walker has a trace
+func (w *matchWalker) nested(d *Device, matcher DeviceMatcher) (bool, []MatchTrace) {
+	if w.trace == nil {
+		return d.walk(matcher, nil), nil
+	}
+	t := MatchTrace{Matched: true}
+	d.walk(matcher, &t)
+	return t.Matched, []MatchTrace{t}
+}
+
+func (w *matchWalker) udev(prefix string, matcher UdevMatcher, data UdevData) bool {
+	for _, env := range matcher.Env {
+		if !w.check(fmt.Sprintf("%s.env[%s]", prefix, env.Name), env.Matches(data.Env), func() (string, string) {
+			value, exists := data.Env[env.Name]
+			return env.String(), quoteOrUnset(value, exists)
+		}) {
+			return false
+		}
+	}
+	lists := []struct {
+		name     string
+		expected []string
+		actual   []string
+	}{
+		{"tags", matcher.Tags, data.Tags},
+		{"current-tags", matcher.CurrentTags, data.CurrentTags},
+		{"symlinks", matcher.Symlinks, data.Symlinks},
+	}
+	for _, list := range lists {
+		for _, value := range list.expected {
+			if !w.check(fmt.Sprintf("%s.%s", prefix, list.name), slices.Contains(list.actual, value), func() (string, string) {
+				return fmt.Sprintf("contains '%s'", value), strings.Join(list.actual, ", ")
+			}) {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// walk evaluates the conditions of the matcher against the device. If trace is nil it stops
+// at the first condition that fails, otherwise all conditions are added to the trace.
+func (d *Device) walk(matcher DeviceMatcher, trace *MatchTrace) bool {
+	w := matchWalker{trace: trace, matched: true}
+	if matcher.Bus != nil && !w.check("bus", matcher.Bus.Contains(int64(d.Bus)), func() (string, string) {
+		return matcher.Bus.String(), fmt.Sprintf("%d", d.Bus)
+	}) {
+		return false
+	}
+	if matcher.Device != nil && !w.check("device", matcher.Device.Contains(int64(d.Device)), func() (string, string) {
+		return matcher.Device.String(), fmt.Sprintf("%d", d.Device)
+	}) {
 		return false
 	}
-	if matcher.Device != nil && *matcher.Device != d.Device {
+	if matcher.VendorID != nil && !w.check("vendor-id", matcher.VendorID.Contains(int64(d.VendorID)), func() (string, string) {
+		return matcher.VendorID.hexString(), fmt.Sprintf("0x%04x", d.VendorID)
+	}) {
 		return false
 	}
-	if matcher.VendorID != nil && *matcher.VendorID != d.VendorID {
+	if matcher.ProductID != nil && !w.check("product-id", matcher.ProductID.Contains(int64(d.ProductID)), func() (string, string) {
+		return matcher.ProductID.hexString(), fmt.Sprintf("0x%04x", d.ProductID)
+	}) {
 		return false
 	}
-	if matcher.ProductID != nil && *matcher.ProductID != d.ProductID {
+	if !w.udev("udev", matcher.Udev, d.Udev) {
 		return false
 	}
-	for _, env := range matcher.Udev.Env {
-		value, exists := d.Udev.Env[env.Name]
-		if !exists {
+	if matcher.Port != nil && !w.check("port", *matcher.Port == d.Port, func() (string, string) {
+		return *matcher.Port, d.Port
+	}) {
+		return false
+	}
+	if matcher.BehindHub != nil && !w.check("behind-hub", slices.Contains(d.Hubs, *matcher.BehindHub), func() (string, string) {
+		return *matcher.BehindHub, strings.Join(d.Hubs, ", ")
+	}) {
+		return false
+	}
+	if matcher.HostNode != nil {
+		path, err := resolveHostNode(*matcher.HostNode)
+		if !w.check("host-node", err == nil && path == d.Sysfs.Path, func() (string, string) {
+			if err != nil {
+				return fmt.Sprintf("%s (%v)", *matcher.HostNode, err), d.Sysfs.Path
+			}
+			return fmt.Sprintf("%s (%s)", *matcher.HostNode, path), d.Sysfs.Path
+		}) {
 			return false
 		}
-		if env.Equals != nil && *env.Equals != value {
+	}
+	for i, intf := range matcher.Interfaces {
+		if !w.check(fmt.Sprintf("interfaces[%d]", i), slices.ContainsFunc(d.Interfaces, intf.Matches), func() (string, string) {
+			actual := make([]string, 0, len(d.Interfaces))
+			for _, intf := range d.Interfaces {
+				actual = append(actual, intf.String())
+			}
+			return intf.String(), strings.Join(actual, "; ")
+		}) {
 			return false
 		}
-		if env.re != nil && !env.re.MatchString(value) {
+	}
+	for i, child := range matcher.Children {
+		idx := slices.IndexFunc(d.Children, child.Matches)
+		if !w.check(fmt.Sprintf("children[%d]", i), idx >= 0, func() (string, string) {
+			if idx < 0 {
+				return child.String(), fmt.Sprintf("none of %d child devices", len(d.Children))
+			}
+			return child.String(), d.Children[idx].Udev.Env["DEVPATH"]
+		}) {
 			return false
 		}
 	}
-	for _, tag := range matcher.Udev.Tags {
-		if !slices.Contains(d.Udev.Tags, tag) {
+	for _, attr := range matcher.Sysfs.Attr {
+		if !w.check(fmt.Sprintf("sysfs.attr[%s]", attr.Name), attr.Matches(d.Sysfs.Attrs), func() (string, string) {
+			value, exists := d.Sysfs.Attrs[attr.Name]
+			return attr.String(), quoteOrUnset(value, exists)
+		}) {
 			return false
 		}
 	}
-	for _, tag := range matcher.Udev.CurrentTags {
-		if !slices.Contains(d.Udev.CurrentTags, tag) {
+	if len(matcher.Sysfs.Attrs) > 0 {
+		sysfsDevices := append([]SysfsDevice{d.Sysfs.SysfsDevice}, d.Sysfs.Parents...)
+		idx := slices.IndexFunc(sysfsDevices, func(s SysfsDevice) bool {
+			for _, attr := range matcher.Sysfs.Attrs {
+				if !attr.Matches(s.Attrs) {
+					return false
+				}
+			}
+			return true
+		})
+		if !w.check("sysfs.attrs", idx >= 0, func() (string, string) {
+			conds := make([]string, 0, len(matcher.Sysfs.Attrs))
+			for _, attr := range matcher.Sysfs.Attrs {
+				conds = append(conds, fmt.Sprintf("%s %s", attr.Name, attr.String()))
+			}
+			if idx < 0 {
+				return strings.Join(conds, ", "), fmt.Sprintf("none of the device and its %d parents", len(d.Sysfs.Parents))
+			}
+			return strings.Join(conds, ", "), sysfsDevices[idx].Path
+		}) {
 			return false
 		}
 	}
-	return true
+	for i, m := range matcher.All {
+		matched, nested := w.nested(d, m)
+		if !w.check(fmt.Sprintf("all[%d]", i), matched, func() (string, string) {
+			return "matches", matchedString(matched)
+		}, nested...) {
+			return false
+		}
+	}
+	if len(matcher.Any) > 0 {
+		var nested []MatchTrace
+		matched := false
+		for _, m := range matcher.Any {
+			ok, trace := w.nested(d, m)
+			matched = matched || ok
+			nested = append(nested, trace...)
+			if matched && w.trace == nil {
+				break
+			}
+		}
+		if !w.check("any", matched, func() (string, string) {
+			return "at least one matches", matchedString(matched)
+		}, nested...) {
+			return false
+		}
+	}
+	if matcher.Not != nil {
+		matched, nested := w.nested(d, *matcher.Not)
+		if !w.check("not", !matched, func() (string, string) {
+			return "does not match", matchedString(matched)
+		}, nested...) {
+			return false
+		}
+	}
+	return w.matched
+}
+
+// Explain evaluates all conditions of the matcher against the device. Unlike a plain match
+// this doesn't stop at the first condition that fails.
+func (d *Device) Explain(matcher DeviceMatcher) MatchTrace {
+	t := MatchTrace{Matched: true}
+	d.walk(matcher, &t)
+	return t
+}
+
+func matchedString(matched bool) string {
+	if matched {
+		return "matches"
+	}
+	return "does not match"
+}
+
+// Matches stops at the first condition that fails, use Explain to evaluate all of them.
+func (d *Device) Matches(matcher DeviceMatcher) bool {
+	return d.walk(matcher, nil)
 }
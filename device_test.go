@@ -0,0 +1,171 @@
+//
+// Copyright (c) 2025 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.libvirt-usb-hotplugd nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func testDevice(bus, device int, vendorID, productID uint16) Device {
+	d := Device{Bus: bus, Device: device, VendorID: vendorID, ProductID: productID}
+	d.Udev.Env = make(map[string]string)
+	return d
+}
+
+func testDeviceMap(devices ...Device) map[string]Device {
+	m := make(map[string]Device)
+	for _, d := range devices {
+		m[d.Slug()] = d
+	}
+	return m
+}
+
+// testMatcher returns the initialized device matcher given in yaml
+func testMatcher(t *testing.T, matcher string) DeviceMatcher {
+	t.Helper()
+	conf := readTestConfig(t, "machines:\n  test:\n    devices:\n    - "+matcher+"\n")
+	return conf.Machines["test"].DeviceMatchers[0]
+}
+
+func TestDeviceMatchesNested(t *testing.T) {
+	webcam := testDevice(1, 2, 0x046d, 0x0825)
+	webcam.Udev.Env["ID_SERIAL"] = "Logitech_C270_ABC123"
+	webcam.Udev.Tags = []string{"uaccess"}
+	mouse := testDevice(1, 3, 0x046d, 0xc077)
+	yubikey := testDevice(1, 4, 0x1050, 0x0407)
+	devices := map[string]Device{"webcam": webcam, "mouse": mouse, "yubikey": yubikey}
+
+	tests := []struct {
+		matcher  string
+		expected []string
+	}{
+		{"all: [{vendor-id: 0x046d}, {udev: {tags: [uaccess]}}]", []string{"webcam"}},
+		{"any: [{product-id: 0x0825}, {vendor-id: 0x1050}]", []string{"webcam", "yubikey"}},
+		{"{vendor-id: 0x046d, not: {product-id: 0x0825}}", []string{"mouse"}},
+		{"not: {any: [{vendor-id: 0x1050}, {product-id: 0xc077}]}", []string{"webcam"}},
+		{"{vendor-id: 0x1050, any: [{product-id: 0x0825}, {product-id: 0x0407}]}", []string{"yubikey"}},
+		{"any: [{all: [{vendor-id: 0x046d}, {not: {udev: {env: [{name: ID_SERIAL, pattern: '^Logitech_'}]}}}]}, {bus: 1, device: 4}]", []string{"mouse", "yubikey"}},
+		{"all: [{any: [{vendor-id: 0x046d}]}, {not: {not: {product-id: 0xc077}}}]", []string{"mouse"}},
+	}
+	for _, test := range tests {
+		matcher := testMatcher(t, test.matcher)
+		var matched []string
+		for _, name := range []string{"webcam", "mouse", "yubikey"} {
+			d := devices[name]
+			if d.Matches(matcher) {
+				matched = append(matched, name)
+			}
+		}
+		if !slices.Equal(matched, test.expected) {
+			t.Errorf("%q: got %q, want %q", test.matcher, matched, test.expected)
+		}
+	}
+}
+
+func TestSetPort(t *testing.T) {
+	tests := []struct {
+		sysfsName string
+		idPath    string
+		port      string
+		hubs      []string
+	}{
+		{sysfsName: "3-6", port: "3-6", hubs: []string{"usb3"}},
+		{sysfsName: "3-6.3", port: "3-6.3", hubs: []string{"3-6", "usb3"}},
+		{sysfsName: "1-2.4.1", idPath: "pci-0000:06:00.3-usb-0:6.3", port: "1-2.4.1", hubs: []string{"1-2.4", "1-2", "usb1"}},
+		{sysfsName: "usb3"},
+		{sysfsName: "3-6:1.0"},
+		{idPath: "pci-0000:06:00.3-usb-0:6.3", port: "3-6.3", hubs: []string{"3-6", "usb3"}},
+		{idPath: "pci-0000:06:00.3-usb-0:6.3:1.0"},
+		{idPath: "platform-i8042-serio-0"},
+		{},
+	}
+	for _, test := range tests {
+		d := testDevice(3, 5, 0x046d, 0x0825)
+		d.Port, d.Hubs = "3-1", []string{"usb3"}
+		if test.idPath != "" {
+			d.Udev.Env["ID_PATH"] = test.idPath
+		}
+		d.SetPort(test.sysfsName)
+		if d.Port != test.port || !slices.Equal(d.Hubs, test.hubs) {
+			t.Errorf("sysfs name %q and ID_PATH %q: got port %q behind hubs %q, want %q behind %q", test.sysfsName, test.idPath, d.Port, d.Hubs, test.port, test.hubs)
+		}
+	}
+}
+
+func TestExplainAgreesWithMatches(t *testing.T) {
+	webcam := testDevice(3, 5, 0x046d, 0x0825)
+	webcam.SetPort("3-6")
+	webcam.Udev.Env["ID_SERIAL"] = "Logitech_C270_ABC123"
+	webcam.Udev.Tags = []string{"uaccess"}
+	webcam.Interfaces = []USBInterface{{Number: 0, Class: 0x0e, SubClass: 0x01}}
+	webcam.Children = []ChildDevice{{Path: "/sys/devices/video0", Subsystem: "video4linux"}}
+	webcam.Sysfs.Attrs = map[string]string{"serial": "ABC123"}
+	webcam.Sysfs.Parents = []SysfsDevice{{Path: "/sys/devices/usb3", Attrs: map[string]string{"speed": "480"}}}
+	mouse := testDevice(3, 7, 0x046d, 0xc077)
+	mouse.SetPort("3-6.2")
+
+	matchers := []string{
+		"bus: 3",
+		"{vendor-id: 0x046d, product-id: 0x0825}",
+		"{vendor-id: 0x046d, product-id: 0xc077, bus: 2}",
+		"udev: {env: [{name: ID_SERIAL, glob: 'Logitech_*'}], tags: [uaccess]}",
+		"udev: {env: [{name: ID_SERIAL, absent: true}], current-tags: [uaccess]}",
+		"port: 3-6",
+		"behind-hub: 3-6",
+		"interfaces: [{class: 0x0e}, {class: 0x01}]",
+		"children: [{subsystem: video4linux}]",
+		"sysfs: {attr: [{name: serial, equals: ABC123}]}",
+		"sysfs: {attrs: [{name: speed, min: 480}]}",
+		"all: [{vendor-id: 0x046d}, {not: {port: 3-6}}]",
+		"any: [{product-id: 0xc077}, {udev: {tags: [uaccess]}}]",
+		"{vendor-id: 0x1050, any: [{bus: 1}, {bus: 2}], not: {bus: 3}}",
+	}
+	for _, text := range matchers {
+		matcher := testMatcher(t, text)
+		for _, d := range []Device{webcam, mouse} {
+			trace := d.Explain(matcher)
+			if matched := d.Matches(matcher); matched != trace.Matched {
+				t.Errorf("%q and device %s: Matches returned %t but Explain %t", text, d.String(), matched, trace.Matched)
+			}
+			passed := !slices.ContainsFunc(trace.Clauses, func(c MatchClause) bool { return !c.Passed })
+			if passed != trace.Matched {
+				t.Errorf("%q and device %s: explanation is %t but the clauses say %t", text, d.String(), trace.Matched, passed)
+			}
+		}
+	}
+
+	// unlike Matches, Explain doesn't stop at the first condition that fails
+	trace := mouse.Explain(testMatcher(t, "{vendor-id: 0x1050, any: [{bus: 1}, {bus: 2}], not: {bus: 3}}"))
+	if len(trace.Clauses) != 3 || len(trace.Clauses[1].Nested) != 2 {
+		t.Errorf("got incomplete explanation %+v", trace)
+	}
+}
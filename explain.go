@@ -0,0 +1,149 @@
+//
+// Copyright (c) 2025 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.libvirt-usb-hotplugd nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+// MachineExplanation explains why a device did or did not match a machine
+type MachineExplanation struct {
+	Machine  string       `json:"machine"`
+	Priority int          `json:"priority"`
+	Matched  bool         `json:"matched"`
+	Devices  []MatchTrace `json:"devices"`
+	Exclude  []MatchTrace `json:"exclude,omitempty"`
+}
+
+// Explanation contains the traces of all matchers of the configuration for a single device
+type Explanation struct {
+	Device      string       `json:"device"`
+	NeverAttach []MatchTrace `json:"never-attach,omitempty"`
+	// Candidates contains all machines that match the device ordered by priority
+	Candidates []string             `json:"candidates"`
+	Machines   []MachineExplanation `json:"machines"`
+}
+
+func ExplainDevice(conf *Config, device Device) *Explanation {
+	e := &Explanation{Device: device.String(), Candidates: machineKeys(conf, matchingMachines(conf, device))}
+	for _, matcher := range conf.NeverAttach {
+		e.NeverAttach = append(e.NeverAttach, device.Explain(matcher))
+	}
+	for _, mname := range sortedMachineNames(conf) {
+		mconf := conf.Machines[mname]
+		me := MachineExplanation{Machine: mconf.Key(), Priority: mconf.Priority, Matched: mconf.Matches(device)}
+		for _, matcher := range mconf.DeviceMatchers {
+			me.Devices = append(me.Devices, device.Explain(matcher))
+		}
+		for _, matcher := range mconf.Exclude {
+			me.Exclude = append(me.Exclude, device.Explain(matcher))
+		}
+		e.Machines = append(e.Machines, me)
+	}
+	return e
+}
+
+// FindDevice looks up a device by its slug, by 'bus/device' or by the path of a device
+// node like /dev/ttyUSB0 or /dev/bus/usb/001/002.
+func FindDevice(devices map[string]Device, spec string) (Device, error) {
+	if device, exists := devices[spec]; exists {
+		return device, nil
+	}
+	if filepath.IsAbs(spec) {
+		path, err := HostNodeToUSBDeviceSysfsPath(spec)
+		if err != nil {
+			return Device{}, err
+		}
+		for _, device := range devices {
+			if device.Sysfs.Path == path {
+				return device, nil
+			}
+		}
+		return Device{}, fmt.Errorf("no USB device found for %s", spec)
+	}
+	var bus, dev int
+	if _, err := fmt.Sscanf(spec, "%d/%d", &bus, &dev); err != nil {
+		return Device{}, fmt.Errorf("invalid device '%s', must be either 'bus/device', a device slug or the path of a device node", spec)
+	}
+	for _, device := range devices {
+		if device.Bus == bus && device.Device == dev {
+			return device, nil
+		}
+	}
+	return Device{}, fmt.Errorf("no USB device found at bus %d device %d", bus, dev)
+}
+
+func writeMatchTrace(w io.Writer, indent string, t MatchTrace) {
+	for _, c := range t.Clauses {
+		result := "pass"
+		if !c.Passed {
+			result = "FAIL"
+		}
+		fmt.Fprintf(w, "%s[%s] %s: expected %s, actual %s\n", indent, result, c.Clause, c.Expected, c.Actual)
+		for i, nested := range c.Nested {
+			fmt.Fprintf(w, "%s  #%d: %s\n", indent, i, matchedString(nested.Matched))
+			writeMatchTrace(w, indent+"    ", nested)
+		}
+	}
+}
+
+func (e *Explanation) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "device: %s\n", e.Device)
+	neverAttach := slices.ContainsFunc(e.NeverAttach, func(t MatchTrace) bool { return t.Matched })
+	fmt.Fprintf(w, "never-attach: %t\n", neverAttach)
+	for i, t := range e.NeverAttach {
+		fmt.Fprintf(w, "  never-attach[%d]: %s\n", i, matchedString(t.Matched))
+		writeMatchTrace(w, "    ", t)
+	}
+	for _, me := range e.Machines {
+		fmt.Fprintf(w, "machine '%s' (priority %d): %s\n", me.Machine, me.Priority, matchedString(me.Matched))
+		for i, t := range me.Devices {
+			fmt.Fprintf(w, "  devices[%d]: %s\n", i, matchedString(t.Matched))
+			writeMatchTrace(w, "    ", t)
+		}
+		for i, t := range me.Exclude {
+			fmt.Fprintf(w, "  exclude[%d]: %s\n", i, matchedString(t.Matched))
+			writeMatchTrace(w, "    ", t)
+		}
+	}
+	switch {
+	case neverAttach:
+		fmt.Fprintf(w, "result: the device is never attached\n")
+	case len(e.Candidates) == 0:
+		fmt.Fprintf(w, "result: the device does not match any machine\n")
+	default:
+		fmt.Fprintf(w, "result: the device is attached to the first running machine of: %s\n", strings.Join(e.Candidates, ", "))
+	}
+}
@@ -0,0 +1,170 @@
+//
+// Copyright (c) 2025 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.libvirt-usb-hotplugd nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	learnPollInterval = 2 * time.Second
+)
+
+// newDevices returns all devices which are not part of before, hubs are only returned if
+// nothing else is new.
+func newDevices(before, after map[string]Device) []Device {
+	var devices, hubs []Device
+	for _, slug := range sortedDeviceSlugs(after) {
+		if _, exists := before[slug]; exists {
+			continue
+		}
+		device := after[slug]
+		// TYPE contains the device class, subclass and protocol
+		if strings.HasPrefix(device.Udev.Env["TYPE"], "9/") {
+			hubs = append(hubs, device)
+			continue
+		}
+		devices = append(devices, device)
+	}
+	if len(devices) == 0 {
+		return hubs
+	}
+	return devices
+}
+
+// waitForNewDevice waits until a device shows up which is not part of before. The bus is
+// rescanned whenever a uevent is received as well as periodically in case uevents are not
+// available.
+func waitForNewDevice(conf *Config, before map[string]Device, timeout time.Duration) (Device, map[string]Device, error) {
+	events := make(chan Uevent, 32)
+	if monitor := startUeventMonitor(conf.UeventSource, events); monitor != nil {
+		defer monitor.Close() //nolint:errcheck
+	}
+	ticker := time.NewTicker(learnPollInterval)
+	defer ticker.Stop()
+	deadline := time.After(timeout)
+
+	var settle <-chan time.Time
+	for {
+		select {
+		case event := <-events:
+			if event.Action == "add" && settle == nil {
+				settle = time.After(ueventSettleTime)
+			}
+			continue
+		case <-settle:
+			settle = nil
+		case <-ticker.C:
+		case <-deadline:
+			return Device{}, nil, fmt.Errorf("no new device showed up within %s", timeout)
+		}
+
+		after, err := ListDevices(conf)
+		if err != nil {
+			return Device{}, nil, fmt.Errorf("failed to list usb devices: %v", err)
+		}
+		devices := newDevices(before, after)
+		switch len(devices) {
+		case 0:
+			continue
+		case 1:
+			return devices[0], after, nil
+		}
+		names := make([]string, 0, len(devices))
+		for _, device := range devices {
+			names = append(names, device.String())
+		}
+		return Device{}, nil, fmt.Errorf("more than one new device showed up, please plug in only one device at a time: %v", names)
+	}
+}
+
+// addMatcherToMachineFile appends the matcher snippet to the devices list of the machine
+// config snippet at filename. The file is created if it does not exist yet.
+func addMatcherToMachineFile(filename, snippet string) error {
+	var matchers yaml.Node
+	if err := yaml.Unmarshal([]byte(snippet), &matchers); err != nil {
+		return fmt.Errorf("failed to parse matcher: %v", err)
+	}
+	matcher := matchers.Content[0].Content[0]
+
+	doc := &yaml.Node{Kind: yaml.DocumentNode, Content: []*yaml.Node{{Kind: yaml.MappingNode, Tag: "!!map"}}}
+	data, err := os.ReadFile(filename)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(bytes.TrimSpace(data)) > 0 {
+		doc = &yaml.Node{}
+		if err = yaml.Unmarshal(data, doc); err != nil {
+			return fmt.Errorf("failed to parse '%s': %v", filename, err)
+		}
+		if len(doc.Content) != 1 || doc.Content[0].Kind != yaml.MappingNode {
+			return fmt.Errorf("failed to parse '%s': not a machine config", filename)
+		}
+	}
+
+	root := doc.Content[0]
+	// the content of a mapping alternates between keys and values, only the keys are of interest
+	idx := -1
+	for i := 0; i+1 < len(root.Content); i += 2 {
+		if root.Content[i].Value == "devices" {
+			idx = i
+			break
+		}
+	}
+	switch {
+	case idx < 0:
+		root.Content = append(root.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: "devices"},
+			&yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq", Content: []*yaml.Node{matcher}})
+	case root.Content[idx+1].Kind == yaml.SequenceNode:
+		root.Content[idx+1].Content = append(root.Content[idx+1].Content, matcher)
+	default:
+		return fmt.Errorf("failed to parse '%s': 'devices' is not a list", filename)
+	}
+
+	var buf bytes.Buffer
+	encoder := yaml.NewEncoder(&buf)
+	encoder.SetIndent(2)
+	if err = encoder.Encode(doc); err != nil {
+		return err
+	}
+	if err = os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+		return err
+	}
+	return os.WriteFile(filename, buf.Bytes(), 0644)
+}
@@ -0,0 +1,114 @@
+//
+// Copyright (c) 2025 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.libvirt-usb-hotplugd nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestAddMatcherToMachineFile(t *testing.T) {
+	const snippet = "- vendor-id: 0x046d\n  product-id: 0x0825\n"
+	tests := []struct {
+		name     string
+		existing *string
+		expected string
+		err      bool
+	}{
+		{
+			name:     "new file",
+			expected: "devices:\n  - vendor-id: 0x046d\n    product-id: 0x0825\n",
+		},
+		{
+			name:     "empty file",
+			existing: ptr("\n"),
+			expected: "devices:\n  - vendor-id: 0x046d\n    product-id: 0x0825\n",
+		},
+		{
+			name:     "existing devices",
+			existing: ptr("priority: 10\ndevices:\n  - vendor-id: 0x1050\n"),
+			expected: "priority: 10\ndevices:\n  - vendor-id: 0x1050\n  - vendor-id: 0x046d\n    product-id: 0x0825\n",
+		},
+		{
+			name:     "devices only as a value",
+			existing: ptr("domain: devices\n"),
+			expected: "domain: devices\ndevices:\n  - vendor-id: 0x046d\n    product-id: 0x0825\n",
+		},
+		{
+			name:     "devices is not a list",
+			existing: ptr("devices: all\n"),
+			err:      true,
+		},
+		{
+			name:     "not a machine config",
+			existing: ptr("- vendor-id: 0x1050\n"),
+			err:      true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			filename := filepath.Join(t.TempDir(), "machines", "test.yml")
+			if test.existing != nil {
+				if err := os.MkdirAll(filepath.Dir(filename), 0755); err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filename, []byte(*test.existing), 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := addMatcherToMachineFile(filename, snippet)
+			if test.err {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if data, _ := os.ReadFile(filename); string(data) != *test.existing {
+					t.Errorf("file has been modified: %q", data)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			data, err := os.ReadFile(filename)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if string(data) != test.expected {
+				t.Errorf("got:\n%s\nwant:\n%s", data, test.expected)
+			}
+		})
+	}
+}
+
+func ptr(s string) *string {
+	return &s
+}
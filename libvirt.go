@@ -0,0 +1,268 @@
+//
+// Copyright (c) 2025 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.libvirt-usb-hotplugd nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+const (
+	libvirtReconnectMinBackoff = time.Second
+	libvirtReconnectMaxBackoff = time.Minute
+)
+
+var (
+	ErrLibvirtNotConnected = errors.New("not connected to libvirt")
+)
+
+// LibvirtConnection holds a single long-lived connection to libvirt which is shared by all
+// libvirt operations using the same URI. If the connection is lost (i.e. because libvirtd got
+// restarted) it will be re-established using an exponential backoff.
+type LibvirtConnection struct {
+	uri    *url.URL
+	cancel context.CancelFunc
+
+	mutex sync.RWMutex
+	l     *libvirt.Libvirt
+
+	events    chan<- MachineEvent
+	connected chan<- string
+}
+
+// Get returns the current connection or ErrLibvirtNotConnected in case libvirt is not reachable
+func (c *LibvirtConnection) Get() (*libvirt.Libvirt, error) {
+	c.mutex.RLock()
+	defer c.mutex.RUnlock()
+
+	if c.l == nil || !c.l.IsConnected() {
+		return nil, ErrLibvirtNotConnected
+	}
+	return c.l, nil
+}
+
+// sessionSocketURI adds the path of the per-user socket to local session URIs like qemu:///session
+// since go-libvirt would otherwise dial the socket of the system instance. The socket of the modular
+// daemon (i.e. virtqemud) is preferred if it exists. URIs which already name a socket are not changed.
+func sessionSocketURI(uri *url.URL) (*url.URL, error) {
+	if uri.Path != "/session" || uri.Host != "" || uri.Query().Has("socket") {
+		return uri, nil
+	}
+	driver, transport, _ := strings.Cut(uri.Scheme, "+")
+	if transport != "" && transport != "unix" {
+		return uri, nil
+	}
+	runtimeDir := os.Getenv("XDG_RUNTIME_DIR")
+	if runtimeDir == "" {
+		return nil, fmt.Errorf("XDG_RUNTIME_DIR is not set, please add the path of the session socket using '?socket=...'")
+	}
+	socket := filepath.Join(runtimeDir, "libvirt", "virt"+driver+"d-sock")
+	if _, err := os.Stat(socket); err != nil {
+		socket = filepath.Join(runtimeDir, "libvirt", "libvirt-sock")
+	}
+	u := *uri
+	query := u.Query()
+	query.Set("socket", socket)
+	u.RawQuery = query.Encode()
+	return &u, nil
+}
+
+func (c *LibvirtConnection) connect(ctx context.Context) (*libvirt.Libvirt, <-chan libvirt.DomainEventLifecycleMsg, error) {
+	uri, err := sessionSocketURI(c.uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	l, err := libvirt.ConnectToURI(uri)
+	if err != nil {
+		return nil, nil, err
+	}
+	msgs, err := l.LifecycleEvents(ctx)
+	if err != nil {
+		l.Disconnect() //nolint:errcheck
+		return nil, nil, err
+	}
+	return l, msgs, nil
+}
+
+func (c *LibvirtConnection) handleEvents(ctx context.Context, l *libvirt.Libvirt, msgs <-chan libvirt.DomainEventLifecycleMsg) {
+	for {
+		select {
+		case msg, ok := <-msgs:
+			if !ok {
+				return
+			}
+			switch libvirt.DomainEventType(msg.Event) {
+			case libvirt.DomainEventStarted, libvirt.DomainEventResumed, libvirt.DomainEventStopped:
+				select {
+				case c.events <- MachineEvent{URI: c.uri.String(), Domain: msg.Dom.Name, Event: libvirt.DomainEventType(msg.Event), Detail: msg.Detail}:
+				case <-ctx.Done():
+					return
+				}
+			}
+		case <-l.Disconnected():
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Run keeps the connection alive until the context is cancelled.
+func (c *LibvirtConnection) Run(ctx context.Context) {
+	backoff := libvirtReconnectMinBackoff
+	for {
+		l, msgs, err := c.connect(ctx)
+		if err != nil {
+			if backoff == libvirtReconnectMinBackoff {
+				wl.Printf("failed to connect to libvirt at %s: %v, will keep retrying", c.uri, err)
+			} else {
+				wdl.Printf("failed to connect to libvirt at %s: %v, retrying in %s", c.uri, err, backoff)
+			}
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			backoff = min(2*backoff, libvirtReconnectMaxBackoff)
+			continue
+		}
+		backoff = libvirtReconnectMinBackoff
+
+		c.mutex.Lock()
+		c.l = l
+		c.mutex.Unlock()
+		wl.Printf("connected to libvirt at %s", c.uri)
+		select {
+		case c.connected <- c.uri.String():
+		case <-ctx.Done():
+		}
+
+		c.handleEvents(ctx, l, msgs)
+
+		c.mutex.Lock()
+		c.l = nil
+		c.mutex.Unlock()
+		if ctx.Err() != nil {
+			l.Disconnect() //nolint:errcheck
+			return
+		}
+		wl.Printf("lost connection to libvirt at %s, reconnecting...", c.uri)
+		l.Disconnect() //nolint:errcheck
+	}
+}
+
+// LibvirtConnections manages one LibvirtConnection per URI.
+type LibvirtConnections struct {
+	ctx   context.Context
+	mutex sync.Mutex
+	conns map[string]*LibvirtConnection
+
+	// Events receives lifecycle events of all domains of all connections
+	Events chan MachineEvent
+	// Connected receives the URI of a connection whenever it has been (re-)established
+	Connected chan string
+}
+
+func NewLibvirtConnections(ctx context.Context) *LibvirtConnections {
+	return &LibvirtConnections{
+		ctx:       ctx,
+		conns:     make(map[string]*LibvirtConnection),
+		Events:    make(chan MachineEvent, 32),
+		Connected: make(chan string, 8),
+	}
+}
+
+// Update opens connections for all URIs used by the configuration and closes the ones that
+// are not needed anymore.
+func (c *LibvirtConnections) Update(conf *Config) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	uris := conf.LibvirtURIs()
+	for _, uri := range uris {
+		if _, exists := c.conns[uri]; exists {
+			continue
+		}
+		u, err := url.Parse(uri)
+		if err != nil {
+			return fmt.Errorf("invalid libvirt URI '%s': %v", uri, err)
+		}
+		ctx, cancel := context.WithCancel(c.ctx)
+		conn := &LibvirtConnection{uri: u, cancel: cancel, events: c.Events, connected: c.Connected}
+		c.conns[uri] = conn
+		go conn.Run(ctx)
+	}
+	for uri, conn := range c.conns {
+		if !slices.Contains(uris, uri) {
+			wdl.Printf("closing connection to libvirt at %s which is no longer in use", uri)
+			conn.cancel()
+			delete(c.conns, uri)
+		}
+	}
+	return nil
+}
+
+// Get returns the current connection for the given URI or ErrLibvirtNotConnected in
+// case libvirt is not reachable
+func (c *LibvirtConnections) Get(uri string) (*libvirt.Libvirt, error) {
+	c.mutex.Lock()
+	conn, exists := c.conns[uri]
+	c.mutex.Unlock()
+	if !exists {
+		return nil, ErrLibvirtNotConnected
+	}
+	return conn.Get()
+}
+
+// WaitConnected waits until the connections to all URIs used by the configuration have been
+// established or the context is done. This must only be used if nobody else reads Connected.
+func (c *LibvirtConnections) WaitConnected(ctx context.Context, conf *Config) error {
+	pending := conf.LibvirtURIs()
+	for len(pending) > 0 {
+		select {
+		case uri := <-c.Connected:
+			pending = slices.DeleteFunc(pending, func(u string) bool { return u == uri })
+		case <-ctx.Done():
+			return fmt.Errorf("failed to connect to libvirt at: %s", strings.Join(pending, ", "))
+		}
+	}
+	return nil
+}
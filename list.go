@@ -0,0 +1,145 @@
+//
+// Copyright (c) 2025 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.libvirt-usb-hotplugd nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"strings"
+)
+
+// deviceListEntry is the representation of a device used by the list-devices command
+type deviceListEntry struct {
+	Device      string            `json:"device" yaml:"device"`
+	Slug        string            `json:"slug" yaml:"slug"`
+	Port        string            `json:"port,omitempty" yaml:"port,omitempty"`
+	Env         map[string]string `json:"env" yaml:"env"`
+	Tags        []string          `json:"tags,omitempty" yaml:"tags,omitempty"`
+	CurrentTags []string          `json:"current-tags,omitempty" yaml:"current-tags,omitempty"`
+	Symlinks    []string          `json:"symlinks,omitempty" yaml:"symlinks,omitempty"`
+	Matcher     string            `json:"matcher,omitempty" yaml:"matcher,omitempty"`
+}
+
+func newDeviceListEntry(device Device, withMatcher bool) (deviceListEntry, error) {
+	e := deviceListEntry{
+		Device:      device.String(),
+		Slug:        device.Slug(),
+		Port:        device.Port,
+		Env:         device.Udev.Env,
+		Tags:        device.Udev.Tags,
+		CurrentTags: device.Udev.CurrentTags,
+		Symlinks:    device.Udev.Symlinks,
+	}
+	if withMatcher {
+		snippet, _, err := SuggestMatcher(device)
+		if err != nil {
+			return e, fmt.Errorf("device %s: %v", device.String(), err)
+		}
+		e.Matcher = snippet
+	}
+	return e, nil
+}
+
+// WriteText prints the entry in the same format as 'udevadm info' does
+func (e deviceListEntry) WriteText(w io.Writer) {
+	fmt.Fprintf(w, "%s\n", e.Device)
+	if devpath, exists := e.Env["DEVPATH"]; exists {
+		fmt.Fprintf(w, "P: %s\n", devpath)
+	}
+	if devname, exists := e.Env["DEVNAME"]; exists {
+		fmt.Fprintf(w, "N: %s\n", strings.TrimPrefix(devname, "/dev/"))
+	}
+	for _, symlink := range e.Symlinks {
+		fmt.Fprintf(w, "S: %s\n", strings.TrimPrefix(symlink, "/dev/"))
+	}
+	keys := make([]string, 0, len(e.Env))
+	for key := range e.Env {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+	for _, key := range keys {
+		fmt.Fprintf(w, "E: %s=%s\n", key, e.Env[key])
+	}
+	for _, tag := range e.Tags {
+		fmt.Fprintf(w, "G: %s\n", tag)
+	}
+	for _, tag := range e.CurrentTags {
+		fmt.Fprintf(w, "Q: %s\n", tag)
+	}
+	if e.Matcher != "" {
+		fmt.Fprintf(w, "\n%s", e.Matcher)
+	}
+	fmt.Fprintln(w)
+}
+
+// usbTopologyName returns the name of the device as used in the hubs list of other devices
+func usbTopologyName(device Device) string {
+	if device.Port == "" {
+		return fmt.Sprintf("usb%d", device.Bus)
+	}
+	return device.Port
+}
+
+// writeDeviceTree prints all devices grouped by the hubs they are connected to. Devices
+// whose hub is unknown are printed at the top level.
+func writeDeviceTree(w io.Writer, devices map[string]Device) {
+	names := make(map[string]bool)
+	for _, device := range devices {
+		names[usbTopologyName(device)] = true
+	}
+	children := make(map[string][]Device)
+	for _, slug := range sortedDeviceSlugs(devices) {
+		device := devices[slug]
+		parent := ""
+		if len(device.Hubs) > 0 && names[device.Hubs[0]] {
+			parent = device.Hubs[0]
+		}
+		children[parent] = append(children[parent], device)
+	}
+
+	var walk func(parent, indent string)
+	walk = func(parent, indent string) {
+		for i, device := range children[parent] {
+			branch, next := "├─ ", "│  "
+			if i == len(children[parent])-1 {
+				branch, next = "└─ ", "   "
+			}
+			if parent == "" {
+				branch, next = "", ""
+			}
+			name := usbTopologyName(device)
+			fmt.Fprintf(w, "%s%s%s  %s\n", indent, branch, name, device.String())
+			walk(name, indent+next)
+		}
+	}
+	walk("", "")
+}
@@ -31,158 +31,121 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"os"
-	"os/signal"
-	"sort"
+	"runtime/debug"
 	"strings"
-	"syscall"
 	"time"
 )
 
+const (
+	debugEnvVar = "WHAWTY_LIBVIRT_USB_HOTPLUGD_DEBUG"
+
+	logLevelInfo  = "info"
+	logLevelDebug = "debug"
+	logFormatText = "text"
+	logFormatJSON = "json"
+
+	logPrefix      = "[whawty.libvirt-usb-hotplugd]\t"
+	debugLogPrefix = "[whawty.libvirt-usb-hotplugd dbg]\t"
+)
+
 var (
-	wl  = log.New(os.Stdout, "[whawty.libvirt-usb-hotplugd]\t", log.LstdFlags)
-	wdl = log.New(io.Discard, "[whawty.libvirt-usb-hotplugd dbg]\t", log.LstdFlags)
+	// version is set at build time using: -ldflags "-X main.version=..."
+	version = ""
+
+	wl  = log.New(os.Stdout, logPrefix, log.LstdFlags)
+	wdl = log.New(io.Discard, debugLogPrefix, log.LstdFlags)
 )
 
 func init() {
-	if _, exists := os.LookupEnv("WHAWTY_LIBVIRT_USB_HOTPLUGD_DEBUG"); exists {
+	if _, exists := os.LookupEnv(debugEnvVar); exists {
 		wdl.SetOutput(os.Stderr)
 	}
 }
 
-func reconcile(conf *Config, devices map[string]Device, machines map[string]Machine) {
-	for mname, mconf := range conf.Machines {
-		machine, exists := machines[mname]
-		if !exists {
-			wdl.Printf("skipping machine '%s' which is listed in the configuration but is not running or missing in libvirt", mname)
-			continue
-		}
-
-		// attach new devices
-		for _, matcher := range mconf.DeviceMatchers {
-			for slug, device := range devices {
-				if !device.Matches(matcher) {
-					continue
-				}
-				if _, exists := machine.Devices[slug]; exists {
-					wdl.Printf("device '%s' is already attached to machine '%s'", device.String(), mname)
-					continue
-				}
-				err := AttachDeviceToVirtualMachine(machine, device)
-				if err != nil {
-					wl.Printf("failed to attach device '%s' to machine '%s': %v", device.String(), mname, err)
-				} else {
-					wl.Printf("successfully attached device '%s' to machine '%s'", device.String(), mname)
-				}
-			}
-		}
-
-		// detach stale devices
-		for _, device := range machine.Devices {
-			match := false
-			if d, exists := devices[device.Slug()]; exists {
-				for _, matcher := range mconf.DeviceMatchers {
-					if d.Matches(matcher) {
-						match = true
-					}
-				}
-			}
-			if !match {
-				err := DetachDeviceFromVirtualMachine(machine, device)
-				if err != nil {
-					wl.Printf("failed to detach device '%s' from machine '%s': %v", device.String(), mname, err)
-				} else {
-					wl.Printf("successfully detached device '%s' from machine '%s'", device.String(), mname)
-				}
-			}
-		}
-	}
+// jsonLogWriter turns every message written by a logger into a single line of JSON
+type jsonLogWriter struct {
+	w     io.Writer
+	level string
 }
 
-func run(conf *Config) {
-	// list usb devices
-	devices, err := ListUSBDevices()
+func (j jsonLogWriter) Write(p []byte) (int, error) {
+	line, err := json.Marshal(struct {
+		Time    time.Time `json:"time"`
+		Level   string    `json:"level"`
+		Message string    `json:"message"`
+	}{time.Now(), j.level, strings.TrimRight(string(p), "\n")})
 	if err != nil {
-		wl.Printf("failed to list usb devices: %v", err)
-		return
+		return 0, err
 	}
-	for _, device := range devices {
-		wdl.Printf("found Device: %s", device.String())
-		keys := make([]string, 0, len(device.Udev.Env))
-		for key := range device.Udev.Env {
-			keys = append(keys, key)
-		}
-		sort.Strings(keys)
-		wdl.Printf("  Env:")
-		for _, key := range keys {
-			wdl.Printf("    %s = %s", key, device.Udev.Env[key])
-		}
-		wdl.Printf("  Tags: %s", strings.Join(device.Udev.Tags, ", "))
-		wdl.Printf("  Current-Tags: %s", strings.Join(device.Udev.CurrentTags, ", "))
-
+	if _, err = j.w.Write(append(line, '\n')); err != nil {
+		return 0, err
 	}
+	return len(p), nil
+}
 
-	// list running virtual machines
-	machines, err := ListActiveVirtualMachines(conf)
-	if err != nil {
-		wl.Printf("failed to list virtual machines: %v", err)
-		return
+// setupLogging configures both loggers. Info messages are written to out, debug messages
+// are written to stderr if enabled.
+func setupLogging(level, format string, out io.Writer) error {
+	var debugOut io.Writer
+	switch level {
+	case logLevelInfo:
+		debugOut = io.Discard
+	case logLevelDebug:
+		debugOut = os.Stderr
+	default:
+		return fmt.Errorf("invalid log level '%s', must be one of: %s, %s", level, logLevelInfo, logLevelDebug)
 	}
-	for _, machine := range machines {
-		wdl.Printf("found VM: %s\n", machine.String())
+	switch format {
+	case logFormatText:
+		wl.SetOutput(out)
+		wl.SetPrefix(logPrefix)
+		wl.SetFlags(log.LstdFlags)
+		wdl.SetOutput(debugOut)
+		wdl.SetPrefix(debugLogPrefix)
+		wdl.SetFlags(log.LstdFlags)
+	case logFormatJSON:
+		wl.SetOutput(jsonLogWriter{w: out, level: logLevelInfo})
+		wl.SetPrefix("")
+		wl.SetFlags(0)
+		wdl.SetOutput(jsonLogWriter{w: debugOut, level: logLevelDebug})
+		wdl.SetPrefix("")
+		wdl.SetFlags(0)
+	default:
+		return fmt.Errorf("invalid log format '%s', must be one of: %s, %s", format, logFormatText, logFormatJSON)
 	}
+	return nil
+}
 
-	// attach/detach devices
-	reconcile(conf, devices, machines)
-
+func versionString() string {
+	v := version
+	if v == "" {
+		v = "unknown"
+		if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" {
+			v = info.Main.Version
+		}
+	}
+	return v
 }
 
 func main() {
-	if len(os.Args) != 2 {
-		fmt.Printf("Usage: %s <config-file>\n", os.Args[0])
+	args := os.Args[1:]
+	if len(args) == 0 {
+		usage()
 		os.Exit(1)
 	}
-	configfile := os.Args[1]
-	conf, err := readConfig(configfile)
-	if err != nil {
-		fmt.Printf("failed to parse config: %v\n", err)
-		os.Exit(1)
+	switch args[0] {
+	case "help", "-h", "-help", "--help":
+		usage()
+		os.Exit(0)
 	}
-	wl.Printf("starting...")
-	// do one initial run so potential problems show up immediately
-	run(conf)
-
-	sigs := make(chan os.Signal, 1)
-	signal.Notify(sigs, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
-	ticker := time.NewTicker(conf.Interval)
-	for {
-		select {
-		case signal := <-sigs:
-			if signal == syscall.SIGHUP {
-				newconf, err := readConfig(configfile)
-				if err != nil {
-					wl.Printf("failed to parse config: %v, keeping old configuration", err)
-					continue
-				}
-				if newconf.Interval != conf.Interval {
-					ticker.Reset(newconf.Interval)
-				}
-				conf = newconf
-				wl.Printf("successfully reloaded configuration from: %s", configfile)
-				continue
-			}
-			wl.Printf("closing after receiving signal: %s", signal.String())
-			return
-		case <-ticker.C:
-			if len(conf.Machines) == 0 {
-				// no machines found in config - no need to scan for devices, but keep running in case the config changes
-				continue
-			}
-			run(conf)
-		}
-
+	if command := findCommand(args[0]); command != nil {
+		os.Exit(command.run(args[1:]))
 	}
+	// legacy invocation: [options] <config-file>
+	os.Exit(cmdRun(args))
 }
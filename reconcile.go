@@ -0,0 +1,616 @@
+//
+// Copyright (c) 2025 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.libvirt-usb-hotplugd nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"cmp"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+// Conflict describes a device that is matched by more than one machine
+type Conflict struct {
+	Device string `json:"device"`
+	// Machines contains all machines that match the device ordered by priority
+	Machines []string `json:"machines"`
+	// Winner is the machine the device gets assigned to, empty if none of the machines is running
+	// or the libvirt connection of a machine which takes precedence is unreachable
+	Winner string `json:"winner,omitempty"`
+}
+
+func (c Conflict) String() string {
+	winner := c.Winner
+	if winner == "" {
+		winner = "none, no matching machine is running or a machine which takes precedence is unreachable"
+	}
+	return fmt.Sprintf("device '%s' matches machines: %s, assigned to: %s", c.Device, strings.Join(c.Machines, ", "), winner)
+}
+
+type ActionType string
+
+const (
+	ActionConflict ActionType = "conflict"
+	ActionSkipped  ActionType = "skipped"
+	ActionDetach   ActionType = "detach"
+	ActionAttach   ActionType = "attach"
+)
+
+// actionTypeOrder is the order in which actions are applied, devices need to be detached
+// before they can be attached to other machines.
+var actionTypeOrder = []ActionType{ActionConflict, ActionSkipped, ActionDetach, ActionAttach}
+
+// Action is a single step of a reconciliation plan. Conflicts and skipped actions are
+// informational only and don't modify any machine.
+type Action struct {
+	Type    ActionType `json:"type"`
+	Device  string     `json:"device,omitempty"`
+	Machine string     `json:"machine,omitempty"`
+	// Machines contains all machines that match the device ordered by priority, this is
+	// only set for conflicts.
+	Machines []string `json:"machines,omitempty"`
+	// Flags is one of live, config or live+config for attach and detach actions
+	Flags  string `json:"flags,omitempty"`
+	Reason string `json:"reason,omitempty"`
+
+	slug    string
+	device  Device
+	machine Machine
+	flags   libvirt.DomainDeviceModifyFlags
+}
+
+func newAction(t ActionType, device *Device, machine *Machine, flags libvirt.DomainDeviceModifyFlags, reason string) Action {
+	a := Action{Type: t, Reason: reason, flags: flags}
+	if device != nil {
+		a.slug = device.Slug()
+		a.device = *device
+		a.Device = device.String()
+	}
+	if machine != nil {
+		a.machine = *machine
+		a.Machine = machine.Key()
+	}
+	if flags != 0 {
+		a.Flags = modifyFlagsString(flags)
+	}
+	return a
+}
+
+func (a Action) Conflict() Conflict {
+	return Conflict{Device: a.Device, Machines: a.Machines, Winner: a.Machine}
+}
+
+func (a Action) String() string {
+	switch a.Type {
+	case ActionAttach:
+		return fmt.Sprintf("attach device '%s' to machine '%s' (%s): %s", a.Device, a.Machine, a.Flags, a.Reason)
+	case ActionDetach:
+		return fmt.Sprintf("detach device '%s' from machine '%s' (%s): %s", a.Device, a.Machine, a.Flags, a.Reason)
+	case ActionConflict:
+		return "conflict: " + a.Conflict().String()
+	}
+	switch {
+	case a.Device == "":
+		return fmt.Sprintf("skip machine '%s': %s", a.Machine, a.Reason)
+	case a.Machine == "":
+		return fmt.Sprintf("skip device '%s': %s", a.Device, a.Reason)
+	}
+	return fmt.Sprintf("skip device '%s' for machine '%s': %s", a.Device, a.Machine, a.Reason)
+}
+
+// Plan contains the actions of a single reconciliation pass in the order they will be applied
+type Plan struct {
+	Actions []Action `json:"actions"`
+
+	// partial is set if the plan only covers some of the machines
+	partial    bool
+	devices    map[string]Device
+	candidates map[string][]string
+	// machines contains the running machines
+	machines map[string]Machine
+	// errs contains the errors of listing the machines, their machines are treated as not running
+	errs []error
+	// unreachable contains the libvirt URIs whose machines could not be listed
+	unreachable []string
+}
+
+func sortActions(actions []Action) {
+	slices.SortStableFunc(actions, func(a, b Action) int {
+		if c := cmp.Compare(slices.Index(actionTypeOrder, a.Type), slices.Index(actionTypeOrder, b.Type)); c != 0 {
+			return c
+		}
+		if c := strings.Compare(a.slug, b.slug); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Machine, b.Machine)
+	})
+}
+
+type Reconciler struct {
+	conns *LibvirtConnections
+	// DryRun only logs the actions instead of applying them
+	DryRun bool
+	// conflicts of the last run, this is used to log every conflict only once
+	conflicts map[string]Conflict
+	// lastRun is the time of the last reconciliation pass and lastErr contains its errors
+	lastRun time.Time
+	lastErr error
+	// status caches the result of Status, it is dropped by every reconciliation pass
+	status     *Status
+	statusConf *Config
+}
+
+func NewReconciler(conns *LibvirtConnections) *Reconciler {
+	return &Reconciler{conns: conns, conflicts: make(map[string]Conflict)}
+}
+
+// Conflicts returns all conflicts that have been detected by previous runs
+func (r *Reconciler) Conflicts() []Conflict {
+	conflicts := make([]Conflict, 0, len(r.conflicts))
+	for _, conflict := range r.conflicts {
+		conflicts = append(conflicts, conflict)
+	}
+	slices.SortFunc(conflicts, func(a, b Conflict) int { return strings.Compare(a.Device, b.Device) })
+	return conflicts
+}
+
+// matchingMachines returns the names of all machines that match the device. The list is ordered
+// by priority (highest first) and name.
+func matchingMachines(conf *Config, device Device) (names []string) {
+	if conf.NeverAttaches(device) {
+		return nil
+	}
+	for mname, mconf := range conf.Machines {
+		if mconf.Matches(device) {
+			names = append(names, mname)
+		}
+	}
+	slices.SortFunc(names, func(a, b string) int {
+		if c := cmp.Compare(conf.Machines[b].Priority, conf.Machines[a].Priority); c != 0 {
+			return c
+		}
+		return strings.Compare(a, b)
+	})
+	return
+}
+
+// competingMachines extends the list of names by all machines that compete with
+// them for at least one device.
+func competingMachines(candidates map[string][]string, names []string) []string {
+	for {
+		extended := false
+		for _, mnames := range candidates {
+			if !slices.ContainsFunc(mnames, func(mname string) bool { return slices.Contains(names, mname) }) {
+				continue
+			}
+			for _, mname := range mnames {
+				if !slices.Contains(names, mname) {
+					names = append(names, mname)
+					extended = true
+				}
+			}
+		}
+		if !extended {
+			return names
+		}
+	}
+}
+
+func machineKeys(conf *Config, mnames []string) []string {
+	keys := make([]string, 0, len(mnames))
+	for _, mname := range mnames {
+		keys = append(keys, conf.Machines[mname].Key())
+	}
+	return keys
+}
+
+// planActions computes the actions needed to bring the running machines in line with the
+// configuration. This does not modify anything.
+func planActions(conf *Config, devices map[string]Device, machines map[string]Machine, candidates map[string][]string, unreachable []string) (actions []Action) {
+	for mname, mconf := range conf.Machines {
+		if _, exists := machines[mname]; !exists {
+			reason := "machine is not running or missing in libvirt"
+			if slices.Contains(unreachable, mconf.LibvirtURI) {
+				reason = "libvirt connection of the machine is unreachable"
+			}
+			actions = append(actions, Action{Type: ActionSkipped, Machine: mconf.Key(), Reason: reason})
+		}
+	}
+
+	// assign every device to the running machine with the highest priority
+	assignments := make(map[string]string)
+	var blocked []string
+	for slug, mnames := range candidates {
+		device := devices[slug]
+		winner, blocker := "", ""
+		for _, mname := range mnames {
+			if _, exists := machines[mname]; exists {
+				winner = mname
+				break
+			}
+			if slices.Contains(unreachable, conf.Machines[mname].LibvirtURI) {
+				// we don't know whether this machine is running
+				blocker = mname
+				break
+			}
+		}
+		if len(mnames) > 1 {
+			action := newAction(ActionConflict, &device, nil, 0, "")
+			action.Machines = machineKeys(conf, mnames)
+			if winner != "" {
+				action.Machine = conf.Machines[winner].Key()
+			}
+			actions = append(actions, action)
+		}
+		if blocker != "" {
+			// failing over would move the device back and forth whenever the connection flaps,
+			// so the device stays where it is until the connection is back
+			reason := fmt.Sprintf("libvirt connection of machine '%s' which takes precedence is unreachable", conf.Machines[blocker].Key())
+			actions = append(actions, newAction(ActionSkipped, &device, nil, 0, reason))
+			blocked = append(blocked, slug)
+			continue
+		}
+		if winner == "" {
+			if len(mnames) > 0 {
+				actions = append(actions, newAction(ActionSkipped, &device, nil, 0, "none of the matching machines is running"))
+			}
+			continue
+		}
+		static := false
+		for _, machine := range machines {
+			if _, exists := machine.StaticDevices[slug]; exists {
+				actions = append(actions, newAction(ActionSkipped, &device, &machine, 0, "device is statically attached to the machine"))
+				static = true
+			}
+		}
+		if !static {
+			assignments[slug] = winner
+		}
+	}
+
+	// detach stale devices
+	for mname, machine := range machines {
+		for slug, device := range machine.Devices {
+			owner, assigned := assignments[slug]
+			if (assigned && owner == mname) || slices.Contains(blocked, slug) {
+				continue
+			}
+			flags := libvirt.DomainDeviceModifyLive
+			if _, exists := machine.ConfigDevices[slug]; exists {
+				flags |= libvirt.DomainDeviceModifyConfig
+			}
+			actions = append(actions, newAction(ActionDetach, &device, &machine, flags, staleReason(conf, mname, device, devices, machines, owner)))
+		}
+		for slug, device := range machine.ConfigDevices {
+			owner, assigned := assignments[slug]
+			if (assigned && owner == mname) || slices.Contains(blocked, slug) {
+				continue
+			}
+			if _, exists := machine.Devices[slug]; !exists {
+				actions = append(actions, newAction(ActionDetach, &device, &machine, libvirt.DomainDeviceModifyConfig, staleReason(conf, mname, device, devices, machines, owner)))
+			}
+		}
+	}
+
+	// attach new devices
+	for slug, mname := range assignments {
+		machine := machines[mname]
+		device := devices[slug]
+		var flags libvirt.DomainDeviceModifyFlags
+		if _, exists := machine.Devices[slug]; !exists {
+			flags |= libvirt.DomainDeviceModifyLive
+		}
+		if conf.Machines[mname].Persistence == persistenceLiveConfig {
+			if _, exists := machine.ConfigDevices[slug]; !exists {
+				flags |= libvirt.DomainDeviceModifyConfig
+			}
+		}
+		if flags == 0 {
+			actions = append(actions, newAction(ActionSkipped, &device, &machine, 0, "device is already attached to the machine"))
+			continue
+		}
+		reason := "device matches the machine"
+		if len(candidates[slug]) > 1 {
+			reason = "device matches the machine which has the highest priority of all running machines"
+		}
+		actions = append(actions, newAction(ActionAttach, &device, &machine, flags, reason))
+	}
+	return
+}
+
+// planInactive computes the actions needed to remove devices from the inactive domain definition
+// of machines which are not running if the device is gone or does not match the machine anymore.
+// Devices which are in use by a running machine are removed as well, otherwise the machine could
+// not be started anymore. Machines which don't use live+config lose all devices we have added.
+func planInactive(conf *Config, devices map[string]Device, machines map[string]Machine, inactive map[string]Machine, candidates map[string][]string, unreachable []string) (actions []Action) {
+	for mname, machine := range inactive {
+		// for inactive domains the devices are the ones of the inactive domain definition
+		for slug, device := range machine.Devices {
+			var reason string
+			_, exists := devices[slug]
+			switch {
+			case conf.Machines[mname].Persistence != persistenceLiveConfig:
+				reason = fmt.Sprintf("machine does not use persistence mode %s", persistenceLiveConfig)
+			case !exists || !slices.Contains(candidates[slug], mname):
+				reason = staleReason(conf, mname, device, devices, nil, "")
+			default:
+				user := runningUser(conf, slug, machines, candidates, unreachable)
+				if user == "" {
+					continue
+				}
+				reason = fmt.Sprintf("device is in use by the running machine '%s'", machines[user].Key())
+			}
+			actions = append(actions, newAction(ActionDetach, &device, &machine, libvirt.DomainDeviceModifyConfig, reason))
+		}
+	}
+	return
+}
+
+// runningUser returns the running machine the device is assigned to or statically attached to
+func runningUser(conf *Config, slug string, machines map[string]Machine, candidates map[string][]string, unreachable []string) string {
+	for _, mname := range candidates[slug] {
+		if _, running := machines[mname]; running {
+			return mname
+		}
+		if slices.Contains(unreachable, conf.Machines[mname].LibvirtURI) {
+			// the assignment of the device is skipped, so it stays with the machine it is attached to
+			for user, machine := range machines {
+				if _, exists := machine.Devices[slug]; exists {
+					return user
+				}
+			}
+			break
+		}
+	}
+	for mname, machine := range machines {
+		if _, exists := machine.StaticDevices[slug]; exists {
+			return mname
+		}
+	}
+	return ""
+}
+
+func modifyFlagsString(flags libvirt.DomainDeviceModifyFlags) string {
+	switch flags {
+	case libvirt.DomainDeviceModifyLive:
+		return persistenceLive
+	case libvirt.DomainDeviceModifyConfig:
+		return "config"
+	case libvirt.DomainDeviceModifyLive | libvirt.DomainDeviceModifyConfig:
+		return persistenceLiveConfig
+	}
+	return fmt.Sprintf("flags=%d", flags)
+}
+
+// staleReason explains why a device attached to a machine needs to be detached
+func staleReason(conf *Config, mname string, device Device, devices map[string]Device, machines map[string]Machine, owner string) string {
+	d, exists := devices[device.Slug()]
+	switch {
+	case !exists:
+		return "device is no longer connected to the host"
+	case conf.NeverAttaches(d):
+		return "device is on the never-attach list"
+	case conf.Machines[mname].Excludes(d):
+		return "device is excluded by the machine"
+	case !conf.Machines[mname].Matches(d):
+		return "device does not match the machine anymore"
+	case owner != "":
+		return fmt.Sprintf("device is assigned to machine '%s' which takes precedence", machines[owner].Key())
+	}
+	return "device is statically attached to another machine"
+}
+
+func (r *Reconciler) attach(machine Machine, device Device, flags libvirt.DomainDeviceModifyFlags) error {
+	err := AttachDeviceToVirtualMachine(r.conns, machine, device, flags)
+	if err != nil {
+		err = fmt.Errorf("failed to attach device '%s' to machine '%s' (%s): %v", device.String(), machine.Key(), modifyFlagsString(flags), err)
+		wl.Printf("%v", err)
+		return err
+	}
+	wl.Printf("successfully attached device '%s' to machine '%s' (%s)", device.String(), machine.Key(), modifyFlagsString(flags))
+	return nil
+}
+
+func (r *Reconciler) detach(machine Machine, device Device, flags libvirt.DomainDeviceModifyFlags, reason string) error {
+	err := DetachDeviceFromVirtualMachine(r.conns, machine, device, flags)
+	if err != nil {
+		err = fmt.Errorf("failed to detach device '%s' from machine '%s' (%s): %v", device.String(), machine.Key(), modifyFlagsString(flags), err)
+		wl.Printf("%v", err)
+		return err
+	}
+	wl.Printf("successfully detached device '%s' from machine '%s' (%s): %s", device.String(), machine.Key(), modifyFlagsString(flags), reason)
+	return nil
+}
+
+func logDevice(device Device) {
+	wdl.Printf("found Device: %s", device.String())
+	keys := make([]string, 0, len(device.Udev.Env))
+	for key := range device.Udev.Env {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	wdl.Printf("  Env:")
+	for _, key := range keys {
+		wdl.Printf("    %s = %s", key, device.Udev.Env[key])
+	}
+	wdl.Printf("  Tags: %s", strings.Join(device.Udev.Tags, ", "))
+	wdl.Printf("  Current-Tags: %s", strings.Join(device.Udev.CurrentTags, ", "))
+	wdl.Printf("  Symlinks: %s", strings.Join(device.Udev.Symlinks, ", "))
+	for _, intf := range device.Interfaces {
+		wdl.Printf("  Interface %d: class=%02x subclass=%02x protocol=%02x driver=%s", intf.Number, intf.Class, intf.SubClass, intf.Protocol, intf.Driver)
+	}
+	for _, child := range device.Children {
+		wdl.Printf("  Child: %s (%s)", child.Udev.Env["DEVPATH"], child.Subsystem)
+	}
+}
+
+// Plan lists all devices and machines and computes the actions of one reconciliation pass
+// without applying them. If names are given only these machines, as well as the machines
+// that compete with them for devices, are taken into account.
+func (r *Reconciler) Plan(conf *Config, names ...string) (*Plan, error) {
+	devices, err := ListDevices(conf)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list usb devices: %v", err)
+	}
+	for _, device := range devices {
+		logDevice(device)
+	}
+
+	plan := &Plan{partial: len(names) > 0, devices: devices, candidates: make(map[string][]string)}
+	for slug, device := range devices {
+		plan.candidates[slug] = matchingMachines(conf, device)
+	}
+	if len(names) > 0 {
+		names = competingMachines(plan.candidates, names)
+		conf = conf.withMachines(names...)
+		for slug, mnames := range plan.candidates {
+			if !slices.ContainsFunc(mnames, func(mname string) bool { return slices.Contains(names, mname) }) {
+				// this device is of no concern for the selected machines
+				delete(plan.candidates, slug)
+			}
+		}
+	}
+
+	machines, unreachable, err := ListActiveVirtualMachines(r.conns, conf, names...)
+	if err != nil {
+		// machines of failed connections are missing and will therefore be skipped
+		wl.Printf("failed to list some virtual machines: %v", err)
+		plan.errs = append(plan.errs, err)
+	}
+	plan.machines = machines
+	plan.unreachable = unreachable
+	for _, machine := range machines {
+		wdl.Printf("found VM: %s\n", machine.String())
+	}
+	plan.Actions = planActions(conf, devices, machines, plan.candidates, plan.unreachable)
+
+	// all machines are checked since machines which used live+config before might still have
+	// some of our devices in their inactive domain definition
+	inactive, _, err := ListInactiveVirtualMachines(r.conns, conf, names...)
+	if err != nil {
+		wl.Printf("failed to list some inactive virtual machines: %v", err)
+		plan.errs = append(plan.errs, err)
+	}
+	plan.Actions = append(plan.Actions, planInactive(conf, devices, machines, inactive, plan.candidates, plan.unreachable)...)
+	sortActions(plan.Actions)
+	return plan, nil
+}
+
+func (r *Reconciler) updateConflicts(plan *Plan) {
+	if !plan.partial {
+		// forget about conflicts of devices which are gone
+		for slug := range r.conflicts {
+			if _, exists := plan.devices[slug]; !exists {
+				delete(r.conflicts, slug)
+			}
+		}
+	}
+	conflicts := make(map[string]Conflict)
+	for _, action := range plan.Actions {
+		if action.Type == ActionConflict {
+			conflicts[action.slug] = action.Conflict()
+		}
+	}
+	for slug := range plan.candidates {
+		conflict, exists := conflicts[slug]
+		if !exists {
+			if old, exists := r.conflicts[slug]; exists {
+				wdl.Printf("conflict for device '%s' has been resolved", old.Device)
+				delete(r.conflicts, slug)
+			}
+			continue
+		}
+		if old, exists := r.conflicts[slug]; !exists || !slices.Equal(old.Machines, conflict.Machines) {
+			wl.Printf("conflict: %s", conflict.String())
+		}
+		r.conflicts[slug] = conflict
+	}
+}
+
+// Apply executes the actions of the plan. In dry-run mode the actions are only logged.
+// Failed actions are logged and returned as a joined error.
+func (r *Reconciler) Apply(plan *Plan) error {
+	r.updateConflicts(plan)
+	var errs []error
+	for _, action := range plan.Actions {
+		switch action.Type {
+		case ActionSkipped:
+			wdl.Printf("%s", action.String())
+			continue
+		case ActionConflict:
+			continue
+		}
+		if r.DryRun {
+			wl.Printf("dry-run, would %s", action.String())
+			continue
+		}
+		var err error
+		switch action.Type {
+		case ActionAttach:
+			err = r.attach(action.machine, action.device, action.flags)
+		case ActionDetach:
+			err = r.detach(action.machine, action.device, action.flags, action.Reason)
+		}
+		if err != nil {
+			errs = append(errs, err)
+		}
+	}
+	for _, conflict := range r.Conflicts() {
+		wdl.Printf("current conflict: %s", conflict.String())
+	}
+	return errors.Join(errs...)
+}
+
+// Run does one reconciliation pass. If names are given only these machines, as well as the
+// machines that compete with them for devices, are taken into account.
+// The outcome is recorded and can be retrieved using LastRun.
+func (r *Reconciler) Run(conf *Config, names ...string) {
+	r.lastRun = time.Now()
+	r.status = nil
+	plan, err := r.Plan(conf, names...)
+	if err != nil {
+		wl.Printf("%v", err)
+		r.lastErr = err
+		return
+	}
+	r.lastErr = errors.Join(append(plan.errs, r.Apply(plan))...)
+}
+
+// LastRun returns the time and the errors of the last reconciliation pass. The time is zero
+// if there hasn't been any pass yet.
+func (r *Reconciler) LastRun() (time.Time, error) {
+	return r.lastRun, r.lastErr
+}
@@ -0,0 +1,357 @@
+//
+// Copyright (c) 2025 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.libvirt-usb-hotplugd nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+
+	"github.com/digitalocean/go-libvirt"
+)
+
+const planTestConfig = `
+machines:
+  low:
+    devices:
+    - vendor-id: [0x046d, 0x1050]
+  high:
+    priority: 10
+    devices:
+    - vendor-id: 0x046d
+      product-id: 0x0825
+  remote:
+    libvirt-uri: qemu+ssh://remote/system
+    priority: 20
+    devices:
+    - vendor-id: 0x1050
+  persistent:
+    persistence: live+config
+    devices:
+    - vendor-id: 0x0403
+`
+
+const excludeTestConfig = `
+never-attach:
+- vendor-id: 0x1050
+  product-id: 0x0407
+machines:
+  low:
+    devices:
+    - vendor-id: 0x046d
+    - vendor-id: 0x1050
+    exclude:
+    - product-id: 0xc077
+  high:
+    priority: 10
+    devices:
+    - vendor-id: 0x046d
+      product-id: 0x0825
+  other:
+    priority: 10
+    devices:
+    - product-id: 0x0825
+`
+
+func TestMatchingMachines(t *testing.T) {
+	conf := readTestConfig(t, excludeTestConfig)
+
+	tests := []struct {
+		name     string
+		device   Device
+		expected []string
+	}{
+		{"ordered by priority and name", testDevice(1, 2, 0x046d, 0x0825), []string{"high", "other", "low"}},
+		{"excluded by the machine", testDevice(1, 3, 0x046d, 0xc077), nil},
+		{"on the never-attach list", testDevice(1, 4, 0x1050, 0x0407), nil},
+		{"not on the never-attach list", testDevice(1, 5, 0x1050, 0x0406), []string{"low"}},
+		{"not matching any machine", testDevice(1, 6, 0x0403, 0x6001), nil},
+	}
+	for _, test := range tests {
+		if got := matchingMachines(conf, test.device); !slices.Equal(got, test.expected) {
+			t.Errorf("%s: got %q, want %q", test.name, got, test.expected)
+		}
+	}
+}
+
+func TestStaleReason(t *testing.T) {
+	conf := readTestConfig(t, excludeTestConfig)
+
+	webcam := testDevice(1, 2, 0x046d, 0x0825)
+	mouse := testDevice(1, 3, 0x046d, 0xc077)
+	yubikey := testDevice(1, 4, 0x1050, 0x0407)
+	other := testDevice(1, 5, 0x1050, 0x0406)
+	devices := testDeviceMap(webcam, mouse, yubikey, other)
+	machines := map[string]Machine{
+		"high": {Name: "high", URI: "qemu:///system", Domain: libvirt.Domain{Name: "high"}},
+	}
+
+	tests := []struct {
+		mname    string
+		device   Device
+		owner    string
+		expected string
+	}{
+		{"low", testDevice(1, 9, 0x046d, 0x0826), "", "device is no longer connected to the host"},
+		{"low", yubikey, "", "device is on the never-attach list"},
+		{"low", mouse, "", "device is excluded by the machine"},
+		{"high", other, "", "device does not match the machine anymore"},
+		{"low", webcam, "high", "device is assigned to machine 'high@qemu:///system' which takes precedence"},
+		{"low", webcam, "", "device is statically attached to another machine"},
+	}
+	for _, test := range tests {
+		if got := staleReason(conf, test.mname, test.device, devices, machines, test.owner); got != test.expected {
+			t.Errorf("device %s of machine %s: got %q, want %q", test.device.String(), test.mname, got, test.expected)
+		}
+	}
+}
+
+func TestPlanActions(t *testing.T) {
+	conf := readTestConfig(t, planTestConfig)
+
+	webcam := testDevice(1, 2, 0x046d, 0x0825)
+	mouse := testDevice(1, 3, 0x046d, 0xc077)
+	yubikey := testDevice(1, 4, 0x1050, 0x0407)
+	serial := testDevice(1, 5, 0x0403, 0x6001)
+	gone := testDevice(1, 9, 0x046d, 0x0826)
+	devices := testDeviceMap(webcam, mouse, yubikey, serial)
+
+	candidates := make(map[string][]string)
+	for slug, device := range devices {
+		candidates[slug] = matchingMachines(conf, device)
+	}
+
+	// machine returns the running machine mname with the given devices attached by us
+	machine := func(mname string, attached ...Device) Machine {
+		mconf := conf.Machines[mname]
+		return Machine{
+			Name:          mname,
+			URI:           mconf.LibvirtURI,
+			Domain:        libvirt.Domain{Name: mconf.Domain},
+			Devices:       testDeviceMap(attached...),
+			StaticDevices: testDeviceMap(),
+			ConfigDevices: testDeviceMap(),
+		}
+	}
+	withConfig := func(m Machine, devices ...Device) Machine {
+		m.ConfigDevices = testDeviceMap(devices...)
+		return m
+	}
+	withStatic := func(m Machine, devices ...Device) Machine {
+		m.StaticDevices = testDeviceMap(devices...)
+		return m
+	}
+
+	tests := []struct {
+		name        string
+		machines    []Machine
+		unreachable []string
+		// expected contains all actions except the skipped machines as 'type slug machine flags'
+		expected []string
+	}{
+		{
+			name: "nothing is running",
+			expected: []string{
+				"conflict 001/002 046d:0825 - -",
+				"conflict 001/004 1050:0407 - -",
+				"skipped 001/002 046d:0825 - -",
+				"skipped 001/003 046d:c077 - -",
+				"skipped 001/004 1050:0407 - -",
+				"skipped 001/005 0403:6001 - -",
+			},
+		},
+		{
+			name:     "devices are attached to the running machine with the highest priority",
+			machines: []Machine{machine("low"), machine("high")},
+			expected: []string{
+				"conflict 001/002 046d:0825 high@qemu:///system -",
+				"conflict 001/004 1050:0407 low@qemu:///system -",
+				"skipped 001/005 0403:6001 - -",
+				"attach 001/002 046d:0825 high@qemu:///system live",
+				"attach 001/003 046d:c077 low@qemu:///system live",
+				"attach 001/004 1050:0407 low@qemu:///system live",
+			},
+		},
+		{
+			name:     "devices are moved to the machine with the highest priority",
+			machines: []Machine{machine("low", webcam, mouse), machine("high")},
+			expected: []string{
+				"conflict 001/002 046d:0825 high@qemu:///system -",
+				"conflict 001/004 1050:0407 low@qemu:///system -",
+				"skipped 001/003 046d:c077 low@qemu:///system -",
+				"skipped 001/005 0403:6001 - -",
+				"detach 001/002 046d:0825 low@qemu:///system live",
+				"attach 001/002 046d:0825 high@qemu:///system live",
+				"attach 001/004 1050:0407 low@qemu:///system live",
+			},
+		},
+		{
+			name:     "devices which are gone are detached",
+			machines: []Machine{machine("high", webcam, gone)},
+			expected: []string{
+				"conflict 001/002 046d:0825 high@qemu:///system -",
+				"conflict 001/004 1050:0407 - -",
+				"skipped 001/002 046d:0825 high@qemu:///system -",
+				"skipped 001/003 046d:c077 - -",
+				"skipped 001/004 1050:0407 - -",
+				"skipped 001/005 0403:6001 - -",
+				"detach 001/009 046d:0826 high@qemu:///system live",
+			},
+		},
+		{
+			name:     "statically attached devices are left alone",
+			machines: []Machine{withStatic(machine("high"), webcam)},
+			expected: []string{
+				"conflict 001/002 046d:0825 high@qemu:///system -",
+				"conflict 001/004 1050:0407 - -",
+				"skipped 001/002 046d:0825 high@qemu:///system -",
+				"skipped 001/003 046d:c077 - -",
+				"skipped 001/004 1050:0407 - -",
+				"skipped 001/005 0403:6001 - -",
+			},
+		},
+		{
+			name:        "devices stay where they are while a machine with higher priority is unreachable",
+			machines:    []Machine{machine("low", yubikey)},
+			unreachable: []string{"qemu+ssh://remote/system"},
+			expected: []string{
+				"conflict 001/002 046d:0825 low@qemu:///system -",
+				"conflict 001/004 1050:0407 - -",
+				"skipped 001/004 1050:0407 - -",
+				"skipped 001/005 0403:6001 - -",
+				"attach 001/002 046d:0825 low@qemu:///system live",
+				"attach 001/003 046d:c077 low@qemu:///system live",
+			},
+		},
+		{
+			name:        "devices are not attached while a machine with higher priority is unreachable",
+			machines:    []Machine{machine("low")},
+			unreachable: []string{"qemu+ssh://remote/system"},
+			expected: []string{
+				"conflict 001/002 046d:0825 low@qemu:///system -",
+				"conflict 001/004 1050:0407 - -",
+				"skipped 001/004 1050:0407 - -",
+				"skipped 001/005 0403:6001 - -",
+				"attach 001/002 046d:0825 low@qemu:///system live",
+				"attach 001/003 046d:c077 low@qemu:///system live",
+			},
+		},
+		{
+			name:     "live+config attaches to both definitions",
+			machines: []Machine{machine("persistent")},
+			expected: []string{
+				"conflict 001/002 046d:0825 - -",
+				"conflict 001/004 1050:0407 - -",
+				"skipped 001/002 046d:0825 - -",
+				"skipped 001/003 046d:c077 - -",
+				"skipped 001/004 1050:0407 - -",
+				"attach 001/005 0403:6001 persistent@qemu:///system live+config",
+			},
+		},
+		{
+			name:     "live+config only adds what is missing",
+			machines: []Machine{machine("persistent", serial)},
+			expected: []string{
+				"conflict 001/002 046d:0825 - -",
+				"conflict 001/004 1050:0407 - -",
+				"skipped 001/002 046d:0825 - -",
+				"skipped 001/003 046d:c077 - -",
+				"skipped 001/004 1050:0407 - -",
+				"attach 001/005 0403:6001 persistent@qemu:///system config",
+			},
+		},
+		{
+			name:     "live+config devices are detached from both definitions",
+			machines: []Machine{withConfig(machine("persistent", serial, webcam), serial, webcam)},
+			expected: []string{
+				"conflict 001/002 046d:0825 - -",
+				"conflict 001/004 1050:0407 - -",
+				"skipped 001/002 046d:0825 - -",
+				"skipped 001/003 046d:c077 - -",
+				"skipped 001/004 1050:0407 - -",
+				"skipped 001/005 0403:6001 persistent@qemu:///system -",
+				"detach 001/002 046d:0825 persistent@qemu:///system live+config",
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			machines := make(map[string]Machine)
+			for _, m := range test.machines {
+				machines[m.Name] = m
+			}
+			actions := planActions(conf, devices, machines, candidates, test.unreachable)
+			sortActions(actions)
+
+			var result []string
+			for _, action := range actions {
+				if action.Device == "" {
+					continue
+				}
+				result = append(result, fmt.Sprintf("%s %s %s %s", action.Type, action.slug, orDash(action.Machine), orDash(action.Flags)))
+			}
+			if !slices.Equal(result, test.expected) {
+				t.Errorf("unexpected actions:\n  got:  %q\n  want: %q", result, test.expected)
+			}
+		})
+	}
+}
+
+func TestPlanActionsSkippedMachines(t *testing.T) {
+	conf := readTestConfig(t, planTestConfig)
+	actions := planActions(conf, nil, map[string]Machine{}, nil, []string{"qemu+ssh://remote/system"})
+	reasons := make(map[string]string)
+	for _, action := range actions {
+		reasons[action.Machine] = action.Reason
+	}
+	expected := map[string]string{
+		"low@qemu:///system":              "machine is not running or missing in libvirt",
+		"high@qemu:///system":             "machine is not running or missing in libvirt",
+		"persistent@qemu:///system":       "machine is not running or missing in libvirt",
+		"remote@qemu+ssh://remote/system": "libvirt connection of the machine is unreachable",
+	}
+	for key, reason := range expected {
+		if reasons[key] != reason {
+			t.Errorf("machine '%s': got reason %q, want %q", key, reasons[key], reason)
+		}
+	}
+	if len(reasons) != len(expected) {
+		t.Errorf("got %d skipped machines, want %d", len(reasons), len(expected))
+	}
+}
+
+func orDash(s string) string {
+	if s == "" {
+		return "-"
+	}
+	return s
+}
@@ -0,0 +1,100 @@
+//
+// Copyright (c) 2025 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.libvirt-usb-hotplugd nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+const (
+	snapshotVersion = 1
+)
+
+// Snapshot contains all USB devices of a host as seen by the daemon. It can be used to
+// replay the devices of another host to find out why a matcher does not behave as expected.
+type Snapshot struct {
+	Version  int               `json:"version"`
+	Created  time.Time         `json:"created"`
+	Hostname string            `json:"hostname,omitempty"`
+	Devices  map[string]Device `json:"devices"`
+}
+
+func NewSnapshot(devices map[string]Device) *Snapshot {
+	hostname, _ := os.Hostname()
+	return &Snapshot{Version: snapshotVersion, Created: time.Now(), Hostname: hostname, Devices: devices}
+}
+
+// Write writes the snapshot to the file at path. If path is '-' the snapshot is written
+// to stdout.
+func (s *Snapshot) Write(path string) error {
+	var w io.Writer = os.Stdout
+	if path != "-" {
+		file, err := os.Create(path)
+		if err != nil {
+			return fmt.Errorf("failed to create snapshot file: %v", err)
+		}
+		defer file.Close() //nolint:errcheck
+		w = file
+	}
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	if err := encoder.Encode(s); err != nil {
+		return fmt.Errorf("failed to write snapshot: %v", err)
+	}
+	return nil
+}
+
+func ReadSnapshot(path string) (*Snapshot, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open snapshot file: %v", err)
+	}
+	defer file.Close() //nolint:errcheck
+
+	s := &Snapshot{}
+	if err = json.NewDecoder(file).Decode(s); err != nil {
+		return nil, fmt.Errorf("failed to parse snapshot file: %v", err)
+	}
+	if s.Version != snapshotVersion {
+		return nil, fmt.Errorf("unsupported snapshot version %d", s.Version)
+	}
+	for slug, device := range s.Devices {
+		if device.Udev.Env == nil {
+			device.Udev.Env = make(map[string]string)
+			s.Devices[slug] = device
+		}
+	}
+	return s, nil
+}
@@ -0,0 +1,95 @@
+//
+// Copyright (c) 2025 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.libvirt-usb-hotplugd nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"text/template"
+
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	matcherSnippetTemplateText = `{{ if .Names }}# {{ .Names }}
+{{ end }}- vendor-id: {{ printf "0x%04x" .VendorID }}
+  product-id: {{ printf "0x%04x" .ProductID }}
+{{- if .Serial }}
+  udev:
+    env:
+    - name: ID_SERIAL_SHORT
+      equals: {{ quote .Serial }}
+{{- else if .Port }}
+  port: {{ quote .Port }}
+{{- end }}
+`
+)
+
+var (
+	matcherSnippetTemplate = template.Must(template.New("matcher-snippet").Funcs(template.FuncMap{"quote": strconv.Quote}).Parse(matcherSnippetTemplateText))
+)
+
+// SuggestMatcher proposes a device matcher for the device which uses the most stable
+// identifiers available. This is the serial number if the device has one and the port
+// it is connected to otherwise. The matcher is returned as a YAML snippet which can be
+// pasted into the devices list of a machine as well as parsed.
+func SuggestMatcher(device Device) (string, DeviceMatcher, error) {
+	data := struct {
+		Names     string
+		VendorID  uint16
+		ProductID uint16
+		Serial    string
+		Port      string
+	}{
+		Names:     strings.TrimSpace(device.VendorName + " " + device.ProductName),
+		VendorID:  device.VendorID,
+		ProductID: device.ProductID,
+		Serial:    device.Udev.Env["ID_SERIAL_SHORT"],
+		Port:      device.Port,
+	}
+	var buf strings.Builder
+	if err := matcherSnippetTemplate.Execute(&buf, data); err != nil {
+		return "", DeviceMatcher{}, err
+	}
+
+	var matchers []DeviceMatcher
+	if err := yaml.Unmarshal([]byte(buf.String()), &matchers); err != nil {
+		return "", DeviceMatcher{}, fmt.Errorf("failed to parse suggested matcher: %v", err)
+	}
+	if len(matchers) != 1 {
+		return "", DeviceMatcher{}, fmt.Errorf("failed to parse suggested matcher: expected exactly one matcher")
+	}
+	if err := matchers[0].initialize("suggestion", "0"); err != nil {
+		return "", DeviceMatcher{}, err
+	}
+	return buf.String(), matchers[0], nil
+}
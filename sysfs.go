@@ -0,0 +1,347 @@
+//
+// Copyright (c) 2025 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.libvirt-usb-hotplugd nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	sysfsDevicesBasePath      = "/sys/devices"
+	sysfsBusUSBDevicesPath    = "/sys/bus/usb/devices"
+	sysfsAttrMaxSize          = 4096
+	sysfsChildDevicesMaxDepth = 16
+)
+
+var (
+	// these are skipped the same way as 'udevadm info --attribute-walk' does
+	sysfsAttrsIgnored = []string{"uevent", "dev", "modalias", "resource", "driver", "subsystem", "module"}
+)
+
+type SysfsDevice struct {
+	Path  string            `json:"path"`
+	Attrs map[string]string `json:"attrs"`
+}
+
+func readSysfsAttr(path string) (string, bool) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", false
+	}
+	defer file.Close() //nolint:errcheck
+
+	data, err := io.ReadAll(io.LimitReader(file, sysfsAttrMaxSize+1))
+	if err != nil || len(data) > sysfsAttrMaxSize {
+		return "", false
+	}
+	// skip binary attributes like USB descriptors or PCI config space
+	if bytes.IndexByte(data, 0) >= 0 || !utf8.Valid(data) {
+		return "", false
+	}
+	return strings.TrimRight(string(data), " \t\r\n"), true
+}
+
+// readSysfsAttrs reads all readable, non-binary attributes of the device at path. Symlinks
+// and subdirectories are skipped.
+func readSysfsAttrs(path string) (map[string]string, error) {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return nil, err
+	}
+	attrs := make(map[string]string)
+	for _, entry := range entries {
+		if !entry.Type().IsRegular() || slices.Contains(sysfsAttrsIgnored, entry.Name()) {
+			continue
+		}
+		if value, ok := readSysfsAttr(filepath.Join(path, entry.Name())); ok {
+			attrs[entry.Name()] = value
+		}
+	}
+	return attrs, nil
+}
+
+func NewSysfsDevice(path string) (SysfsDevice, error) {
+	attrs, err := readSysfsAttrs(path)
+	if err != nil {
+		return SysfsDevice{}, err
+	}
+	return SysfsDevice{Path: path, Attrs: attrs}, nil
+}
+
+// sysfsAttrSelection selects the attributes which are read for every device and its parents.
+// Matching only needs the attributes used by the matchers, reading all of them is only needed
+// to show them or to take a snapshot. The same goes for the interfaces and child devices which
+// are only read if children is set.
+type sysfsAttrSelection struct {
+	all      bool
+	device   []string
+	parents  []string
+	children bool
+}
+
+var sysfsAttrsAll = sysfsAttrSelection{all: true, children: true}
+
+func (s *sysfsAttrSelection) add(names *[]string, name string) {
+	if !slices.Contains(*names, name) && !slices.Contains(sysfsAttrsIgnored, name) {
+		*names = append(*names, name)
+	}
+}
+
+// read returns the device at path with either all or only the given attributes
+func (s sysfsAttrSelection) read(path string, names []string) (SysfsDevice, error) {
+	if s.all {
+		return NewSysfsDevice(path)
+	}
+	attrs := make(map[string]string)
+	for _, name := range names {
+		if value, ok := readSysfsAttr(filepath.Join(path, name)); ok {
+			attrs[name] = value
+		}
+	}
+	return SysfsDevice{Path: path, Attrs: attrs}, nil
+}
+
+// readSysfsDeviceAndParents reads the selected attributes of the device at path as well as the
+// ones of all of its parents. Every directory above path which contains an uevent file is
+// considered to be a parent device. Parents are skipped if none of their attributes are needed.
+func readSysfsDeviceAndParents(device *Device, path string, attrs sysfsAttrSelection) error {
+	sysfsDevice, err := attrs.read(path, attrs.device)
+	if err != nil {
+		return err
+	}
+	device.Sysfs.SysfsDevice = sysfsDevice
+
+	device.Sysfs.Parents = nil
+	if !attrs.all && len(attrs.parents) == 0 {
+		return nil
+	}
+	for parent := filepath.Dir(path); strings.HasPrefix(parent, hostPath(sysfsDevicesBasePath)+"/"); parent = filepath.Dir(parent) {
+		if _, err := os.Stat(filepath.Join(parent, "uevent")); err != nil {
+			continue
+		}
+		sysfsParent, err := attrs.read(parent, attrs.parents)
+		if err != nil {
+			return err
+		}
+		device.Sysfs.Parents = append(device.Sysfs.Parents, sysfsParent)
+	}
+	return nil
+}
+
+// udevDataID returns the name of the file in the udev data directory of a device
+func udevDataID(path string, env map[string]string) string {
+	if env["MAJOR"] != "" && env["MINOR"] != "" {
+		prefix := "c"
+		if env["SUBSYSTEM"] == "block" {
+			prefix = "b"
+		}
+		return fmt.Sprintf("%s%s:%s", prefix, env["MAJOR"], env["MINOR"])
+	}
+	if env["IFINDEX"] != "" {
+		return "n" + env["IFINDEX"]
+	}
+	return fmt.Sprintf("+%s:%s", env["SUBSYSTEM"], filepath.Base(path))
+}
+
+func readUSBInterface(path string) (intf USBInterface, err error) {
+	fields := []struct {
+		name  string
+		value *uint8
+	}{
+		{"bInterfaceNumber", &intf.Number},
+		{"bInterfaceClass", &intf.Class},
+		{"bInterfaceSubClass", &intf.SubClass},
+		{"bInterfaceProtocol", &intf.Protocol},
+	}
+	for _, field := range fields {
+		value, ok := readSysfsAttr(filepath.Join(path, field.name))
+		if !ok {
+			return intf, fmt.Errorf("failed to read %s", field.name)
+		}
+		v, err := strconv.ParseUint(value, 16, 8)
+		if err != nil {
+			return intf, fmt.Errorf("failed to parse %s: %v", field.name, err)
+		}
+		*field.value = uint8(v)
+	}
+	if driver, err := os.Readlink(filepath.Join(path, "driver")); err == nil {
+		intf.Driver = filepath.Base(driver)
+	}
+	return intf, nil
+}
+
+func readChildDevice(path string) (child ChildDevice, err error) {
+	child.Path = path
+	child.Udev.Env = make(map[string]string)
+	if err = readUeventFile(&child.Udev, path); err != nil {
+		return
+	}
+	if subsystem, err := os.Readlink(filepath.Join(path, "subsystem")); err == nil {
+		child.Subsystem = filepath.Base(subsystem)
+		child.Udev.Env["SUBSYSTEM"] = child.Subsystem
+	}
+	child.Udev.Env["DEVPATH"] = devpathFromSysfsPath(path)
+
+	udevDataPath := filepath.Join(hostPath(udevDataBasePath), udevDataID(path, child.Udev.Env))
+	if err := readUdevData(&child.Udev, udevDataPath); err != nil && !os.IsNotExist(err) {
+		wdl.Printf("failed to read udev attributes from udev/data file for %s: %v", path, err)
+	}
+	return
+}
+
+func walkChildDevices(device *Device, path string, depth int) error {
+	if depth > sysfsChildDevicesMaxDepth {
+		return nil
+	}
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		// this also skips symlinks like 'subsystem', 'driver' or 'port' which point elsewhere
+		if !entry.IsDir() {
+			continue
+		}
+		childPath := filepath.Join(path, entry.Name())
+		if _, err := os.Stat(filepath.Join(childPath, "uevent")); err == nil {
+			child, err := readChildDevice(childPath)
+			if err != nil {
+				// children might vanish while we walk them, this must not hide all the other ones
+				wdl.Printf("failed to read child device %s: %v", childPath, err)
+				continue
+			}
+			if child.Udev.Env["DEVTYPE"] == "usb_device" {
+				// this is another USB device connected to a hub
+				continue
+			}
+			if child.Udev.Env["DEVTYPE"] == "usb_interface" {
+				intf, err := readUSBInterface(childPath)
+				if err != nil {
+					wdl.Printf("failed to read USB interface %s: %v", childPath, err)
+				} else {
+					device.Interfaces = append(device.Interfaces, intf)
+				}
+			}
+			device.Children = append(device.Children, child)
+		}
+		// some devices are nested inside directories which are not devices themselves, i.e. .../ttyUSB0/tty/ttyUSB0
+		if err := walkChildDevices(device, childPath, depth+1); err != nil {
+			wdl.Printf("failed to read child devices of %s: %v", childPath, err)
+		}
+	}
+	return nil
+}
+
+// readChildDevices collects all USB interfaces and other descendant devices of the USB device at path
+func readChildDevices(device *Device, path string) error {
+	device.Interfaces = nil
+	device.Children = nil
+	return walkChildDevices(device, path, 0)
+}
+
+// SysfsUSBEnumerator lists USB devices by walking /sys/bus/usb/devices. Unlike libusb it
+// never opens the device nodes which might currently be owned by a virtual machine.
+type SysfsUSBEnumerator struct{}
+
+func (SysfsUSBEnumerator) List() ([]Device, error) {
+	entries, err := os.ReadDir(hostPath(sysfsBusUSBDevicesPath))
+	if err != nil {
+		return nil, err
+	}
+	var devices []Device
+	for _, entry := range entries {
+		// interfaces are named like '3-6:1.0'
+		if strings.Contains(entry.Name(), ":") {
+			continue
+		}
+		d, err := NewDeviceFromSysfs(filepath.Join(hostPath(sysfsBusUSBDevicesPath), entry.Name()))
+		if err != nil {
+			wl.Printf("ignoring USB device %s: %v", entry.Name(), err)
+			continue
+		}
+		devices = append(devices, d)
+	}
+	return devices, nil
+}
+
+// NewDeviceFromSysfs reads the identifiers and names of the USB device at path. Everything
+// else is filled in by ListUSBDevices.
+func NewDeviceFromSysfs(path string) (d Device, err error) {
+	if d.Sysfs.Path, err = resolveSymlink(path); err != nil {
+		return
+	}
+	hexFields := []struct {
+		name  string
+		value *uint16
+	}{
+		{"idVendor", &d.VendorID},
+		{"idProduct", &d.ProductID},
+	}
+	for _, field := range hexFields {
+		value, ok := readSysfsAttr(filepath.Join(d.Sysfs.Path, field.name))
+		if !ok {
+			return d, fmt.Errorf("failed to read %s", field.name)
+		}
+		v, err := strconv.ParseUint(value, 16, 16)
+		if err != nil {
+			return d, fmt.Errorf("failed to parse %s: %v", field.name, err)
+		}
+		*field.value = uint16(v)
+	}
+	decFields := []struct {
+		name  string
+		value *int
+	}{
+		{"busnum", &d.Bus},
+		{"devnum", &d.Device},
+	}
+	for _, field := range decFields {
+		value, ok := readSysfsAttr(filepath.Join(d.Sysfs.Path, field.name))
+		if !ok {
+			return d, fmt.Errorf("failed to read %s", field.name)
+		}
+		if *field.value, err = strconv.Atoi(value); err != nil {
+			return d, fmt.Errorf("failed to parse %s: %v", field.name, err)
+		}
+	}
+	d.VendorName, _ = readSysfsAttr(filepath.Join(d.Sysfs.Path, "manufacturer"))
+	d.ProductName, _ = readSysfsAttr(filepath.Join(d.Sysfs.Path, "product"))
+	d.Udev.Env = make(map[string]string)
+	return d, nil
+}
@@ -0,0 +1,285 @@
+//
+// Copyright (c) 2025 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.libvirt-usb-hotplugd nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+const sysfsTestController = "/sys/devices/pci0000:00/0000:00:14.0"
+
+// writeSysfsTestFixture creates a sysroot containing an USB root hub with a webcam connected
+// to port 6 and a device on port 7 whose attributes can't be read. The files are created at
+// runtime since module zips can't contain symlinks or colons in file names.
+func writeSysfsTestFixture(t *testing.T) string {
+	t.Helper()
+	root := t.TempDir()
+	files := map[string]string{
+		sysfsTestController + "/uevent": "DRIVER=xhci_hcd\nPCI_CLASS=C0330\n",
+		sysfsTestController + "/vendor": "0x8086\n",
+
+		sysfsTestController + "/usb3/uevent":    "MAJOR=189\nMINOR=256\nDEVNAME=bus/usb/003/001\nDEVTYPE=usb_device\n",
+		sysfsTestController + "/usb3/idVendor":  "1d6b\n",
+		sysfsTestController + "/usb3/idProduct": "0002\n",
+		sysfsTestController + "/usb3/busnum":    "3\n",
+		sysfsTestController + "/usb3/devnum":    "1\n",
+		sysfsTestController + "/usb3/product":   "xHCI Host Controller\n",
+
+		sysfsTestController + "/usb3/3-6/uevent":       "MAJOR=189\nMINOR=260\nDEVNAME=bus/usb/003/005\nDEVTYPE=usb_device\n",
+		sysfsTestController + "/usb3/3-6/idVendor":     "046d\n",
+		sysfsTestController + "/usb3/3-6/idProduct":    "0825\n",
+		sysfsTestController + "/usb3/3-6/busnum":       "3\n",
+		sysfsTestController + "/usb3/3-6/devnum":       "5\n",
+		sysfsTestController + "/usb3/3-6/manufacturer": "Logitech\n",
+		sysfsTestController + "/usb3/3-6/product":      "C270\n",
+		sysfsTestController + "/usb3/3-6/serial":       "ABC123\n",
+
+		sysfsTestController + "/usb3/3-6/3-6:1.0/uevent":             "DEVTYPE=usb_interface\nINTERFACE=14/1/0\n",
+		sysfsTestController + "/usb3/3-6/3-6:1.0/bInterfaceNumber":   "00\n",
+		sysfsTestController + "/usb3/3-6/3-6:1.0/bInterfaceClass":    "0e\n",
+		sysfsTestController + "/usb3/3-6/3-6:1.0/bInterfaceSubClass": "01\n",
+		sysfsTestController + "/usb3/3-6/3-6:1.0/bInterfaceProtocol": "00\n",
+
+		sysfsTestController + "/usb3/3-6/3-6:1.0/video4linux/video0/uevent": "MAJOR=81\nMINOR=0\nDEVNAME=video0\n",
+
+		sysfsTestController + "/usb3/3-7/uevent": "DEVTYPE=usb_device\n",
+		sysfsTestController + "/usb3/3-7/busnum": "3\n",
+
+		"/run/udev/data/c189:260": "I:1234\nE:ID_SERIAL=Logitech_C270_ABC123\nE:ID_VENDOR_FROM_DATABASE=Logitech, Inc.\nE:ID_MODEL_FROM_DATABASE=Webcam C270\nS:webcam\nG:uaccess\nQ:uaccess\n",
+		"/run/udev/data/c81:0":    "E:ID_V4L_CAPABILITIES=:capture:\nS:v4l/by-id/usb-Logitech_C270-video-index0\n",
+	}
+	symlinks := map[string]string{
+		"/sys/bus/usb/devices/usb3":    "../../../devices/pci0000:00/0000:00:14.0/usb3",
+		"/sys/bus/usb/devices/3-6":     "../../../devices/pci0000:00/0000:00:14.0/usb3/3-6",
+		"/sys/bus/usb/devices/3-6:1.0": "../../../devices/pci0000:00/0000:00:14.0/usb3/3-6/3-6:1.0",
+		"/sys/bus/usb/devices/3-7":     "../../../devices/pci0000:00/0000:00:14.0/usb3/3-7",
+
+		sysfsTestController + "/usb3/3-6/3-6:1.0/driver":                       "../../../../../../bus/usb/drivers/uvcvideo",
+		sysfsTestController + "/usb3/3-6/3-6:1.0/video4linux/video0/subsystem": "../../../../../../../../class/video4linux",
+	}
+	for name, content := range files {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, target := range symlinks {
+		path := filepath.Join(root, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Symlink(target, path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+// setTestSysroot points all sysfs, udev and /dev paths to root for the duration of the test
+func setTestSysroot(t *testing.T, root string) {
+	old := sysroot
+	sysroot = root
+	t.Cleanup(func() { sysroot = old })
+}
+
+func TestSysfsUSBEnumerator(t *testing.T) {
+	root := writeSysfsTestFixture(t)
+	setTestSysroot(t, root)
+	controller := filepath.Join(root, sysfsTestController)
+
+	devices, err := ListUSBDevices(SysfsUSBEnumerator{}, sysfsAttrsAll)
+	if err != nil {
+		t.Fatalf("failed to list devices: %v", err)
+	}
+	if slugs := slices.Sorted(maps.Keys(devices)); !slices.Equal(slugs, []string{"003/001 1d6b:0002", "003/005 046d:0825"}) {
+		t.Fatalf("got devices %q", slugs)
+	}
+
+	tests := []struct {
+		slug        string
+		path        string
+		vendorName  string
+		productName string
+		port        string
+		hubs        []string
+		env         map[string]string
+		symlinks    []string
+		tags        []string
+		attrs       map[string]string
+		parents     []string
+		interfaces  []USBInterface
+		children    map[string]string
+	}{
+		{
+			slug:        "003/001 1d6b:0002",
+			path:        controller + "/usb3",
+			productName: "xHCI Host Controller",
+			env: map[string]string{
+				"DEVPATH":   "/devices/pci0000:00/0000:00:14.0/usb3",
+				"DEVNAME":   "/dev/bus/usb/003/001",
+				"SUBSYSTEM": "usb",
+			},
+			attrs:    map[string]string{"idVendor": "1d6b", "idProduct": "0002", "busnum": "3", "devnum": "1", "product": "xHCI Host Controller"},
+			parents:  []string{controller},
+			children: map[string]string{},
+		},
+		{
+			slug:        "003/005 046d:0825",
+			path:        controller + "/usb3/3-6",
+			vendorName:  "Logitech, Inc.",
+			productName: "Webcam C270",
+			port:        "3-6",
+			hubs:        []string{"usb3"},
+			env: map[string]string{
+				"DEVPATH":          "/devices/pci0000:00/0000:00:14.0/usb3/3-6",
+				"DEVNAME":          "/dev/bus/usb/003/005",
+				"SUBSYSTEM":        "usb",
+				"ID_SERIAL":        "Logitech_C270_ABC123",
+				"USEC_INITIALIZED": "1234",
+			},
+			symlinks:   []string{"/dev/webcam"},
+			tags:       []string{"uaccess"},
+			attrs:      map[string]string{"idVendor": "046d", "idProduct": "0825", "busnum": "3", "devnum": "5", "manufacturer": "Logitech", "product": "C270", "serial": "ABC123"},
+			parents:    []string{controller + "/usb3", controller},
+			interfaces: []USBInterface{{Number: 0, Class: 0x0e, SubClass: 0x01, Protocol: 0, Driver: "uvcvideo"}},
+			children: map[string]string{
+				controller + "/usb3/3-6/3-6:1.0":                    "",
+				controller + "/usb3/3-6/3-6:1.0/video4linux/video0": "video4linux",
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.slug, func(t *testing.T) {
+			d := devices[test.slug]
+			if d.Sysfs.Path != test.path {
+				t.Errorf("got path %s, want %s", d.Sysfs.Path, test.path)
+			}
+			if d.VendorName != test.vendorName || d.ProductName != test.productName {
+				t.Errorf("got names %q %q, want %q %q", d.VendorName, d.ProductName, test.vendorName, test.productName)
+			}
+			if d.Port != test.port || !slices.Equal(d.Hubs, test.hubs) {
+				t.Errorf("got port %q behind hubs %q, want %q behind %q", d.Port, d.Hubs, test.port, test.hubs)
+			}
+			for key, value := range test.env {
+				if d.Udev.Env[key] != value {
+					t.Errorf("udev env %s: got %q, want %q", key, d.Udev.Env[key], value)
+				}
+			}
+			if !slices.Equal(d.Udev.Symlinks, test.symlinks) || !slices.Equal(d.Udev.Tags, test.tags) {
+				t.Errorf("got symlinks %q and tags %q, want %q and %q", d.Udev.Symlinks, d.Udev.Tags, test.symlinks, test.tags)
+			}
+			if !maps.Equal(d.Sysfs.Attrs, test.attrs) {
+				t.Errorf("got sysfs attributes %v, want %v", d.Sysfs.Attrs, test.attrs)
+			}
+			var parents []string
+			for _, parent := range d.Sysfs.Parents {
+				parents = append(parents, parent.Path)
+			}
+			if !slices.Equal(parents, test.parents) {
+				t.Errorf("got parents %q, want %q", parents, test.parents)
+			}
+			if !slices.Equal(d.Interfaces, test.interfaces) {
+				t.Errorf("got interfaces %v, want %v", d.Interfaces, test.interfaces)
+			}
+			children := make(map[string]string)
+			for _, child := range d.Children {
+				children[child.Path] = child.Subsystem
+			}
+			if !maps.Equal(children, test.children) {
+				t.Errorf("got children %v, want %v", children, test.children)
+			}
+		})
+	}
+
+	video := devices["003/005 046d:0825"].Children[1]
+	if video.Udev.Env["DEVNAME"] != "/dev/video0" || !slices.Equal(video.Udev.Symlinks, []string{"/dev/v4l/by-id/usb-Logitech_C270-video-index0"}) {
+		t.Errorf("child device %s: got udev data %v", video.Path, video.Udev)
+	}
+}
+
+func TestSysfsUSBEnumeratorAttrSelection(t *testing.T) {
+	setTestSysroot(t, writeSysfsTestFixture(t))
+
+	attrs := sysfsAttrSelection{device: []string{"serial", "missing"}, parents: []string{"vendor"}}
+	devices, err := ListUSBDevices(SysfsUSBEnumerator{}, attrs)
+	if err != nil {
+		t.Fatalf("failed to list devices: %v", err)
+	}
+	d := devices["003/005 046d:0825"]
+	if !maps.Equal(d.Sysfs.Attrs, map[string]string{"serial": "ABC123"}) {
+		t.Errorf("got sysfs attributes %v", d.Sysfs.Attrs)
+	}
+	// every parent only contains the selected attributes
+	var vendors []string
+	for _, parent := range d.Sysfs.Parents {
+		vendors = append(vendors, parent.Attrs["vendor"])
+	}
+	if !slices.Equal(vendors, []string{"", "0x8086"}) {
+		t.Errorf("got vendor attributes of parents %q", vendors)
+	}
+	// interfaces and child devices are only read if selected
+	if d.Interfaces != nil || d.Children != nil {
+		t.Errorf("got interfaces %v and children %v which have not been selected", d.Interfaces, d.Children)
+	}
+	attrs.children = true
+	if devices, err = ListUSBDevices(SysfsUSBEnumerator{}, attrs); err != nil {
+		t.Fatalf("failed to list devices: %v", err)
+	}
+	if d = devices["003/005 046d:0825"]; len(d.Interfaces) != 1 || len(d.Children) != 2 {
+		t.Errorf("got interfaces %v and children %v", d.Interfaces, d.Children)
+	}
+}
+
+func TestConfigSysfsAttrSelection(t *testing.T) {
+	tests := []struct {
+		matcher  string
+		children bool
+	}{
+		{"vendor-id: 0x046d", false},
+		{"sysfs: {attr: [{name: serial, equals: ABC123}]}", false},
+		{"interfaces: [{class: 0x0e}]", true},
+		{"children: [{subsystem: tty}]", true},
+		{"any: [{vendor-id: 0x046d}, {not: {interfaces: [{class: 0x03}]}}]", true},
+	}
+	for _, test := range tests {
+		conf := readTestConfig(t, "machines:\n  test:\n    devices:\n    - "+test.matcher+"\n")
+		if attrs := conf.sysfsAttrSelection(); attrs.children != test.children {
+			t.Errorf("%q: got children selected %t, want %t", test.matcher, attrs.children, test.children)
+		}
+	}
+}
@@ -0,0 +1,187 @@
+//
+// Copyright (c) 2025 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.libvirt-usb-hotplugd nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/unix"
+)
+
+const (
+	ueventSourceUdev     = "udev"
+	ueventSourceKernel   = "kernel"
+	ueventSourceDisabled = "disabled"
+
+	ueventNetlinkGroupKernel = 1
+	ueventNetlinkGroupUdev   = 2
+
+	udevMonitorMagic = 0xfeedcafe
+
+	// ueventActionResync is used for events generated by the monitor itself if some events got lost
+	ueventActionResync = "resync"
+	// ueventReadBackoffMax limits the time between retries after failing to read from the socket
+	ueventReadBackoffMax = time.Minute
+)
+
+type Uevent struct {
+	Action  string
+	DevPath string
+	Env     map[string]string
+}
+
+func (e *Uevent) IsUSBDevice() bool {
+	return e.Env["SUBSYSTEM"] == "usb" && e.Env["DEVTYPE"] == "usb_device"
+}
+
+func (e *Uevent) String() string {
+	if e.Action == ueventActionResync {
+		return "resync after some events have been lost"
+	}
+	return fmt.Sprintf("%s %s (%s/%s)", e.Action, e.DevPath, e.Env["SUBSYSTEM"], e.Env["DEVTYPE"])
+}
+
+func parseUeventProperties(e *Uevent, data []byte) {
+	for _, field := range bytes.Split(data, []byte{0}) {
+		key, value, err := splitKeyValue(string(field))
+		if err != nil {
+			// silently ignore invalid fields
+			continue
+		}
+		e.Env[key] = value
+	}
+	e.Action = e.Env["ACTION"]
+	e.DevPath = e.Env["DEVPATH"]
+}
+
+// parseUevent handles both, messages sent by the kernel (ACTION@DEVPATH followed by the
+// properties) as well as messages sent by udev (libudev monitor header followed by the properties)
+func parseUevent(msg []byte) (*Uevent, error) {
+	e := &Uevent{Env: make(map[string]string)}
+	if bytes.HasPrefix(msg, []byte("libudev\x00")) {
+		if len(msg) < 24 {
+			return nil, errors.New("udev message is too short")
+		}
+		if magic := binary.BigEndian.Uint32(msg[8:12]); magic != udevMonitorMagic {
+			return nil, fmt.Errorf("udev message has invalid magic: 0x%08x", magic)
+		}
+		propertiesOff := binary.NativeEndian.Uint32(msg[16:20])
+		propertiesLen := binary.NativeEndian.Uint32(msg[20:24])
+		if uint64(propertiesOff)+uint64(propertiesLen) > uint64(len(msg)) {
+			return nil, errors.New("udev message properties are out of bounds")
+		}
+		parseUeventProperties(e, msg[propertiesOff:propertiesOff+propertiesLen])
+		return e, nil
+	}
+
+	header, properties, found := bytes.Cut(msg, []byte{0})
+	if !found || !bytes.Contains(header, []byte("@")) {
+		return nil, errors.New("kernel message has invalid header")
+	}
+	parseUeventProperties(e, properties)
+	return e, nil
+}
+
+type UeventMonitor struct {
+	file *os.File
+}
+
+func NewUeventMonitor(source string) (*UeventMonitor, error) {
+	groups := uint32(ueventNetlinkGroupUdev)
+	switch source {
+	case ueventSourceUdev:
+	case ueventSourceKernel:
+		groups = ueventNetlinkGroupKernel
+	default:
+		return nil, fmt.Errorf("invalid uevent source: '%s'", source)
+	}
+
+	fd, err := unix.Socket(unix.AF_NETLINK, unix.SOCK_RAW|unix.SOCK_CLOEXEC|unix.SOCK_NONBLOCK, unix.NETLINK_KOBJECT_UEVENT)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create netlink socket: %v", err)
+	}
+	if err = unix.Bind(fd, &unix.SockaddrNetlink{Family: unix.AF_NETLINK, Groups: groups}); err != nil {
+		unix.Close(fd) //nolint:errcheck
+		return nil, fmt.Errorf("failed to bind netlink socket: %v", err)
+	}
+	// using os.NewFile on a non-blocking socket makes reads go through the runtime poller
+	// this way Close() will also interrupt a pending Read()
+	return &UeventMonitor{file: os.NewFile(uintptr(fd), "uevent-netlink")}, nil
+}
+
+// Run reads uevents from the netlink socket and sends all events concerning USB devices to
+// the given channel. If some events have been lost, an event with the action resync is sent
+// instead. It returns after the monitor has been closed.
+func (m *UeventMonitor) Run(events chan<- Uevent) {
+	buf := make([]byte, 64*1024)
+	var backoff time.Duration
+	for {
+		n, err := m.file.Read(buf)
+		if err != nil {
+			if errors.Is(err, os.ErrClosed) {
+				return
+			}
+			if errors.Is(err, unix.ENOBUFS) {
+				// the socket buffer overflowed, since we don't know which devices changed the
+				// receiver needs to rescan all of them
+				wl.Printf("some uevents have been lost, requesting a resync")
+				events <- Uevent{Action: ueventActionResync, Env: make(map[string]string)}
+				continue
+			}
+			backoff = min(max(2*backoff, time.Second), ueventReadBackoffMax)
+			wl.Printf("failed to read from uevent netlink socket: %v, retrying in %s", err, backoff)
+			time.Sleep(backoff)
+			continue
+		}
+		backoff = 0
+		event, err := parseUevent(buf[:n])
+		if err != nil {
+			wdl.Printf("ignoring invalid uevent message: %v", err)
+			continue
+		}
+		if !event.IsUSBDevice() {
+			continue
+		}
+		switch event.Action {
+		case "add", "remove":
+			events <- *event
+		}
+	}
+}
+
+func (m *UeventMonitor) Close() error {
+	return m.file.Close()
+}
@@ -0,0 +1,144 @@
+//
+// Copyright (c) 2025 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.libvirt-usb-hotplugd nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+package main
+
+import (
+	"encoding/binary"
+	"maps"
+	"strings"
+	"testing"
+)
+
+// udevMessage builds a message like the ones sent by udev: the libudev monitor header
+// followed by the properties
+func udevMessage(magic uint32, properties string, propertiesLen uint32) []byte {
+	const headerSize = 40
+	msg := make([]byte, headerSize)
+	copy(msg, "libudev\x00")
+	binary.BigEndian.PutUint32(msg[8:12], magic)
+	binary.NativeEndian.PutUint32(msg[12:16], headerSize)
+	binary.NativeEndian.PutUint32(msg[16:20], headerSize)
+	binary.NativeEndian.PutUint32(msg[20:24], propertiesLen)
+	return append(msg, properties...)
+}
+
+func TestParseUevent(t *testing.T) {
+	properties := strings.Join([]string{
+		"ACTION=add",
+		"DEVPATH=/devices/pci0000:00/0000:00:14.0/usb3/3-6",
+		"SUBSYSTEM=usb",
+		"DEVTYPE=usb_device",
+		"PRODUCT=46d/825/10",
+		"invalid",
+		"ID_SERIAL=Logitech_Webcam_C270=ABC",
+	}, "\x00") + "\x00"
+	expected := map[string]string{
+		"ACTION":    "add",
+		"DEVPATH":   "/devices/pci0000:00/0000:00:14.0/usb3/3-6",
+		"SUBSYSTEM": "usb",
+		"DEVTYPE":   "usb_device",
+		"PRODUCT":   "46d/825/10",
+		"ID_SERIAL": "Logitech_Webcam_C270=ABC",
+	}
+
+	tests := []struct {
+		name     string
+		msg      []byte
+		err      bool
+		expected map[string]string
+	}{
+		{
+			name:     "kernel",
+			msg:      []byte("add@/devices/pci0000:00/0000:00:14.0/usb3/3-6\x00" + properties),
+			expected: expected,
+		},
+		{
+			name:     "kernel without properties",
+			msg:      []byte("remove@/devices/pci0000:00/0000:00:14.0/usb3/3-6\x00"),
+			expected: map[string]string{},
+		},
+		{
+			name: "kernel with invalid header",
+			msg:  []byte("add /devices/pci0000:00/0000:00:14.0/usb3/3-6\x00" + properties),
+			err:  true,
+		},
+		{
+			name: "kernel without terminated header",
+			msg:  []byte("add@/devices/pci0000:00/0000:00:14.0/usb3/3-6"),
+			err:  true,
+		},
+		{
+			name:     "udev",
+			msg:      udevMessage(udevMonitorMagic, properties, uint32(len(properties))),
+			expected: expected,
+		},
+		{
+			name:     "udev with properties shorter than the message",
+			msg:      udevMessage(udevMonitorMagic, properties+"IGNORED=1\x00", uint32(len(properties))),
+			expected: expected,
+		},
+		{
+			name: "udev with invalid magic",
+			msg:  udevMessage(0xdeadbeef, properties, uint32(len(properties))),
+			err:  true,
+		},
+		{
+			name: "udev with properties out of bounds",
+			msg:  udevMessage(udevMonitorMagic, properties, uint32(len(properties))+1),
+			err:  true,
+		},
+		{
+			name: "udev too short",
+			msg:  []byte("libudev\x00\xfe\xed\xca\xfe"),
+			err:  true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			e, err := parseUevent(test.msg)
+			if test.err {
+				if err == nil {
+					t.Fatalf("expected an error, got %v", e.Env)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if !maps.Equal(e.Env, test.expected) {
+				t.Errorf("got %v, want %v", e.Env, test.expected)
+			}
+			if e.Action != test.expected["ACTION"] || e.DevPath != test.expected["DEVPATH"] {
+				t.Errorf("got action %q and devpath %q, want %q and %q", e.Action, e.DevPath, test.expected["ACTION"], test.expected["DEVPATH"])
+			}
+		})
+	}
+}
@@ -39,32 +39,138 @@ import (
 	"strings"
 	"syscall"
 
-	"github.com/Emposat/usb"
 	"golang.org/x/sys/unix"
 )
 
 const (
+	usbBackendSysfs  = "sysfs"
+	usbBackendLibUSB = "libusb"
+
 	devBusUSBBasePath     = "/dev/bus/usb"
 	udevDataBasePath      = "/run/udev/data"
 	sysfsDevBlockBasePath = "/sys/dev/block"
 	sysfsDevCharBasePath  = "/sys/dev/char"
 )
 
-func USBDeviceToSysfsDevicesAndUdevDataPath(dev Device) (string, string, error) {
-	devBusUSBPath := filepath.Join(devBusUSBBasePath, fmt.Sprintf("%03d/%03d", dev.Bus, dev.Device))
-	info, err := os.Stat(devBusUSBPath)
+var (
+	// sysroot is prepended to all paths in sysfs, the udev data directory and /dev. This is
+	// useful to run the daemon inside a container where these are bind-mounted from the host.
+	sysroot = "/"
+	// deviceSnapshot is set if the devices are read from a snapshot. Device nodes of the host
+	// don't belong to these devices and must not be used.
+	deviceSnapshot = ""
+
+	// hostNodes caches the results of HostNodeToUSBDeviceSysfsPath for the devices of the last
+	// call to ListUSBDevices, so every host-node is only resolved once per reconciliation pass.
+	hostNodes = make(map[string]hostNodeResult)
+)
+
+type hostNodeResult struct {
+	path string
+	err  error
+}
+
+// hostPath returns the path at which the host path is available to us
+func hostPath(path string) string {
+	return filepath.Join(sysroot, path)
+}
+
+// devpathFromSysfsPath returns the path of a device in sysfs without the /sys prefix, which is
+// what udev calls DEVPATH
+func devpathFromSysfsPath(path string) string {
+	return strings.TrimPrefix(path, hostPath("/sys"))
+}
+
+// resolveSymlink returns the target of the symlink at path. Absolute targets are
+// interpreted relative to the sysroot.
+func resolveSymlink(path string) (string, error) {
+	target, err := os.Readlink(path)
 	if err != nil {
-		return "", "", fmt.Errorf("device %s failed to stat(%s): %v", dev.String(), devBusUSBPath, err)
+		return "", err
+	}
+	if filepath.IsAbs(target) {
+		return hostPath(target), nil
+	}
+	return filepath.Join(filepath.Dir(path), target), nil
+}
+
+// maxSymlinks is the maximum number of symlinks followed while resolving a path, like ELOOP
+const maxSymlinks = 40
+
+// resolveHostPath follows all symlinks of the host path and returns the path at which the
+// resulting file is available to us. Unlike filepath.EvalSymlinks absolute targets are
+// interpreted relative to the sysroot, so the result never escapes the sysroot.
+func resolveHostPath(path string) (string, error) {
+	resolved := "/"
+	rest := strings.Split(path, "/")
+	links := 0
+	for len(rest) > 0 {
+		name := rest[0]
+		rest = rest[1:]
+		switch name {
+		case "", ".":
+			continue
+		case "..":
+			resolved = filepath.Dir(resolved)
+			continue
+		}
+		next := filepath.Join(resolved, name)
+		info, err := os.Lstat(hostPath(next))
+		if err != nil {
+			return "", err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			resolved = next
+			continue
+		}
+		if links++; links > maxSymlinks {
+			return "", fmt.Errorf("too many levels of symbolic links: %s", path)
+		}
+		target, err := os.Readlink(hostPath(next))
+		if err != nil {
+			return "", err
+		}
+		if filepath.IsAbs(target) {
+			resolved = "/"
+		}
+		rest = append(strings.Split(target, "/"), rest...)
+	}
+	return hostPath(resolved), nil
+}
+
+// USBEnumerator lists the USB devices connected to the host. Implementations only need to
+// fill in the identifiers of the devices and, if known, their path in sysfs.
+type USBEnumerator interface {
+	List() ([]Device, error)
+}
+
+// usbEnumerators contains all USB backends compiled into the binary
+var usbEnumerators = map[string]USBEnumerator{
+	usbBackendSysfs: SysfsUSBEnumerator{},
+}
+
+// DeviceNodeToSysfsDevicesAndUdevDataPath resolves the device node at devNodePath, which
+// may also be a symlink, to the path of the device in sysfs and the udev data file. The
+// sysroot is prepended to devNodePath as well as the returned paths.
+func DeviceNodeToSysfsDevicesAndUdevDataPath(devNodePath string) (string, string, error) {
+	resolved, err := resolveHostPath(devNodePath)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to resolve %s: %v", devNodePath, err)
+	}
+	devNodePath = resolved
+	info, err := os.Stat(devNodePath)
+	if err != nil {
+		return "", "", fmt.Errorf("failed to stat(%s): %v", devNodePath, err)
 	}
 	if info.Mode()&os.ModeDevice == 0 {
-		return "", "", fmt.Errorf("%s is not a device file", devBusUSBPath)
+		return "", "", fmt.Errorf("%s is not a device file", devNodePath)
 	}
-	sysfsDevBasePath := sysfsDevCharBasePath
+	sysfsDevBasePath := hostPath(sysfsDevCharBasePath)
 	udevDataNamePrefix := "c"
 	if info.Mode()&os.ModeCharDevice == 0 {
 		// not sure if this is necessary - even USB-Sticks are character devices at this level
 		// but since this check is cheap and easy let's keep it in here.
-		sysfsDevBasePath = sysfsDevBlockBasePath
+		sysfsDevBasePath = hostPath(sysfsDevBlockBasePath)
 		udevDataNamePrefix = "b"
 	}
 
@@ -76,19 +182,58 @@ func USBDeviceToSysfsDevicesAndUdevDataPath(dev Device) (string, string, error)
 	minor := unix.Minor(stat_t.Rdev)
 
 	sysfsDevPath := filepath.Join(sysfsDevBasePath, fmt.Sprintf("%d:%d", major, minor))
-	sysfsDevicesPath, err := os.Readlink(sysfsDevPath)
+	sysfsDevicesPath, err := resolveSymlink(sysfsDevPath)
 	if err != nil {
 		return "", "", fmt.Errorf("could not resolve symlink %s: %v", sysfsDevPath, err)
 	}
-	if !filepath.IsAbs(sysfsDevicesPath) {
-		sysfsDevicesPath = filepath.Join(sysfsDevBasePath, sysfsDevicesPath)
-	}
 
-	udevDataPath := filepath.Join(udevDataBasePath, fmt.Sprintf("%s%d:%d", udevDataNamePrefix, major, minor))
+	udevDataPath := filepath.Join(hostPath(udevDataBasePath), fmt.Sprintf("%s%d:%d", udevDataNamePrefix, major, minor))
+
+	return sysfsDevicesPath, udevDataPath, nil
+}
 
+func USBDeviceToSysfsDevicesAndUdevDataPath(dev Device) (string, string, error) {
+	devBusUSBPath := filepath.Join(devBusUSBBasePath, fmt.Sprintf("%03d/%03d", dev.Bus, dev.Device))
+	sysfsDevicesPath, udevDataPath, err := DeviceNodeToSysfsDevicesAndUdevDataPath(devBusUSBPath)
+	if err != nil {
+		return "", "", fmt.Errorf("device %s: %v", dev.String(), err)
+	}
 	return sysfsDevicesPath, udevDataPath, nil
 }
 
+// HostNodeToUSBDeviceSysfsPath resolves the device node at path, i.e. /dev/ttyUSB0 or
+// /dev/serial/by-id/..., and returns the sysfs path of the USB device it belongs to.
+func HostNodeToUSBDeviceSysfsPath(path string) (string, error) {
+	if deviceSnapshot != "" {
+		return "", fmt.Errorf("device node %s can not be resolved since the devices are read from the snapshot %s", path, deviceSnapshot)
+	}
+	sysfsDevicesPath, _, err := DeviceNodeToSysfsDevicesAndUdevDataPath(path)
+	if err != nil {
+		return "", err
+	}
+	for dir := sysfsDevicesPath; strings.HasPrefix(dir, hostPath(sysfsDevicesBasePath)+"/"); dir = filepath.Dir(dir) {
+		udev := UdevData{Env: make(map[string]string)}
+		if err := readUeventFile(&udev, dir); err != nil {
+			continue
+		}
+		if udev.Env["DEVTYPE"] == "usb_device" {
+			return dir, nil
+		}
+	}
+	return "", fmt.Errorf("%s does not belong to an USB device", path)
+}
+
+// resolveHostNode is the same as HostNodeToUSBDeviceSysfsPath but only resolves every device
+// node once until the devices are listed again.
+func resolveHostNode(path string) (string, error) {
+	if result, exists := hostNodes[path]; exists {
+		return result.path, result.err
+	}
+	sysfsPath, err := HostNodeToUSBDeviceSysfsPath(path)
+	hostNodes[path] = hostNodeResult{path: sysfsPath, err: err}
+	return sysfsPath, err
+}
+
 func splitKeyValue(line string) (string, string, error) {
 	fields := strings.SplitN(line, "=", 2)
 	if len(fields) != 2 {
@@ -97,7 +242,7 @@ func splitKeyValue(line string) (string, string, error) {
 	return fields[0], fields[1], nil
 }
 
-func readUeventFile(device *Device, basePath string) error {
+func readUeventFile(udev *UdevData, basePath string) error {
 	file, err := os.Open(filepath.Join(basePath, "uevent"))
 	if err != nil {
 		return err
@@ -116,12 +261,12 @@ func readUeventFile(device *Device, basePath string) error {
 			value = filepath.Join("/dev", value)
 		}
 
-		device.Udev.Env[key] = value
+		udev.Env[key] = value
 	}
 	return scanner.Err()
 }
 
-func readUdevData(device *Device, path string) error {
+func readUdevData(udev *UdevData, path string) error {
 	file, err := os.Open(path)
 	if err != nil {
 		return err
@@ -137,15 +282,17 @@ func readUdevData(device *Device, path string) error {
 		}
 		switch fields[0] {
 		case "I":
-			device.Udev.Env["USEC_INITIALIZED"] = fields[1]
+			udev.Env["USEC_INITIALIZED"] = fields[1]
 		case "G":
-			device.Udev.Tags = append(device.Udev.Tags, fields[1])
+			udev.Tags = append(udev.Tags, fields[1])
 		case "Q":
-			device.Udev.CurrentTags = append(device.Udev.CurrentTags, fields[1])
+			udev.CurrentTags = append(udev.CurrentTags, fields[1])
+		case "S":
+			udev.Symlinks = append(udev.Symlinks, filepath.Join("/dev", fields[1]))
 		case "E":
 			key, value, err := splitKeyValue(fields[1])
 			if err == nil {
-				device.Udev.Env[key] = value
+				udev.Env[key] = value
 			}
 			// silently ignore invalid lines
 		}
@@ -153,31 +300,73 @@ func readUdevData(device *Device, path string) error {
 	return scanner.Err()
 }
 
-func ListUSBDevices() (map[string]Device, error) {
-	devices, err := usb.List()
+// readUSBDeviceDetails fills in everything besides the identifiers of the device which
+// are provided by the USB enumerator. Only the selected sysfs attributes are read, interfaces
+// and child devices only if they are selected as well.
+func readUSBDeviceDetails(d *Device, attrs sysfsAttrSelection) {
+	sysfsDevicesPath := d.Sysfs.Path
+	if sysfsDevicesPath == "" {
+		var err error
+		if sysfsDevicesPath, _, err = USBDeviceToSysfsDevicesAndUdevDataPath(*d); err != nil {
+			wl.Printf("failed to resolve sysfs and udev paths for %s: %v", d.Slug(), err)
+			return
+		}
+	}
+
+	d.Udev.Env["DEVPATH"] = devpathFromSysfsPath(sysfsDevicesPath)
+	d.Udev.Env["SUBSYSTEM"] = "usb"
+	if err := readUeventFile(&d.Udev, sysfsDevicesPath); err != nil {
+		wl.Printf("failed to read udev attributes from uevent file for %s: %v", d.Slug(), err)
+	}
+	udevDataPath := filepath.Join(hostPath(udevDataBasePath), udevDataID(sysfsDevicesPath, d.Udev.Env))
+	if err := readUdevData(&d.Udev, udevDataPath); err != nil {
+		wl.Printf("failed to read udev attributes from udev/data file for %s: %v", d.Slug(), err)
+	}
+	if err := readSysfsDeviceAndParents(d, sysfsDevicesPath, attrs); err != nil {
+		wl.Printf("failed to read sysfs attributes for %s: %v", d.Slug(), err)
+	}
+	if attrs.children {
+		if err := readChildDevices(d, sysfsDevicesPath); err != nil {
+			wl.Printf("failed to read interfaces and child devices for %s: %v", d.Slug(), err)
+		}
+	}
+	d.SetPort(filepath.Base(sysfsDevicesPath))
+
+	// prefer the names from the USB ID database, the same way lsusb does
+	if name := d.Udev.Env["ID_VENDOR_FROM_DATABASE"]; name != "" {
+		d.VendorName = name
+	}
+	if name := d.Udev.Env["ID_MODEL_FROM_DATABASE"]; name != "" {
+		d.ProductName = name
+	}
+}
+
+func ListUSBDevices(enumerator USBEnumerator, attrs sysfsAttrSelection) (map[string]Device, error) {
+	// device nodes might belong to different devices now
+	hostNodes = make(map[string]hostNodeResult)
+	devices, err := enumerator.List()
 	if err != nil {
 		return nil, err
 	}
 
 	result := make(map[string]Device)
-	for _, device := range devices {
-		d := NewDeviceFromLibUSB(device)
+	for _, d := range devices {
+		readUSBDeviceDetails(&d, attrs)
+		result[d.Slug()] = d
+	}
+	return result, nil
+}
 
-		sysfsDevicesPath, udevDataPath, err := USBDeviceToSysfsDevicesAndUdevDataPath(d)
+// ListDevices returns the devices from the snapshot file if one is configured and the
+// devices currently connected to the host otherwise. Only the sysfs attributes used by the
+// matchers of the configuration are read.
+func ListDevices(conf *Config) (map[string]Device, error) {
+	if conf.DeviceSnapshot != "" {
+		snapshot, err := ReadSnapshot(conf.DeviceSnapshot)
 		if err != nil {
-			wl.Printf("failed to resolve sysfs and udev paths for %s: %v", d.Slug(), err)
-		} else {
-			d.Udev.Env["DEVPATH"] = strings.TrimPrefix(sysfsDevicesPath, "/sys")
-			d.Udev.Env["SUBSYSTEM"] = "usb"
-			if err := readUeventFile(&d, sysfsDevicesPath); err != nil {
-				wl.Printf("failed to read udev attributes from uevent file for %s: %v", d.Slug(), err)
-			}
-			if err := readUdevData(&d, udevDataPath); err != nil {
-				wl.Printf("failed to read udev attributes from udev/data file for %s: %v", d.Slug(), err)
-			}
+			return nil, err
 		}
-
-		result[d.Slug()] = d
+		return snapshot.Devices, nil
 	}
-	return result, nil
+	return ListUSBDevices(usbEnumerators[conf.USBBackend], conf.sysfsAttrSelection())
 }
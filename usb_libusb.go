@@ -0,0 +1,68 @@
+//
+// Copyright (c) 2025 whawty contributors (see AUTHORS file)
+// All rights reserved.
+//
+// Redistribution and use in source and binary forms, with or without
+// modification, are permitted provided that the following conditions are met:
+//
+// * Redistributions of source code must retain the above copyright notice, this
+//   list of conditions and the following disclaimer.
+//
+// * Redistributions in binary form must reproduce the above copyright notice,
+//   this list of conditions and the following disclaimer in the documentation
+//   and/or other materials provided with the distribution.
+//
+// * Neither the name of whawty.libvirt-usb-hotplugd nor the names of its
+//   contributors may be used to endorse or promote products derived from
+//   this software without specific prior written permission.
+//
+// THIS SOFTWARE IS PROVIDED BY THE COPYRIGHT HOLDERS AND CONTRIBUTORS "AS IS"
+// AND ANY EXPRESS OR IMPLIED WARRANTIES, INCLUDING, BUT NOT LIMITED TO, THE
+// IMPLIED WARRANTIES OF MERCHANTABILITY AND FITNESS FOR A PARTICULAR PURPOSE ARE
+// DISCLAIMED. IN NO EVENT SHALL THE COPYRIGHT HOLDER OR CONTRIBUTORS BE LIABLE
+// FOR ANY DIRECT, INDIRECT, INCIDENTAL, SPECIAL, EXEMPLARY, OR CONSEQUENTIAL
+// DAMAGES (INCLUDING, BUT NOT LIMITED TO, PROCUREMENT OF SUBSTITUTE GOODS OR
+// SERVICES; LOSS OF USE, DATA, OR PROFITS; OR BUSINESS INTERRUPTION) HOWEVER
+// CAUSED AND ON ANY THEORY OF LIABILITY, WHETHER IN CONTRACT, STRICT LIABILITY,
+// OR TORT (INCLUDING NEGLIGENCE OR OTHERWISE) ARISING IN ANY WAY OUT OF THE USE
+// OF THIS SOFTWARE, EVEN IF ADVISED OF THE POSSIBILITY OF SUCH DAMAGE.
+//
+
+//go:build libusb
+
+package main
+
+import (
+	"github.com/Emposat/usb"
+)
+
+func init() {
+	usbEnumerators[usbBackendLibUSB] = LibUSBEnumerator{}
+}
+
+// LibUSBEnumerator lists USB devices using github.com/Emposat/usb. This reads the
+// descriptors through the device nodes in /dev/bus/usb.
+type LibUSBEnumerator struct{}
+
+func (LibUSBEnumerator) List() ([]Device, error) {
+	devices, err := usb.List()
+	if err != nil {
+		return nil, err
+	}
+	result := make([]Device, 0, len(devices))
+	for _, device := range devices {
+		result = append(result, NewDeviceFromLibUSB(device))
+	}
+	return result, nil
+}
+
+func NewDeviceFromLibUSB(libusb *usb.Device) (d Device) {
+	d.VendorID = libusb.Vendor.ID
+	d.ProductID = libusb.Product.ID
+	d.Bus = libusb.Bus
+	d.Device = libusb.Device
+	d.VendorName = libusb.Vendor.Name()
+	d.ProductName = libusb.Product.Name()
+	d.Udev.Env = make(map[string]string)
+	return
+}
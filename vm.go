@@ -31,8 +31,10 @@
 package main
 
 import (
+	"errors"
 	"fmt"
-	"net/url"
+	"maps"
+	"slices"
 	"strings"
 
 	"github.com/antchfx/xmlquery"
@@ -40,61 +42,120 @@ import (
 )
 
 type Machine struct {
+	Name    string
+	URI     string
 	Domain  libvirt.Domain
 	Devices map[string]Device
+	// StaticDevices are USB hostdevs which have not been attached by us
+	StaticDevices map[string]Device
+	// ConfigDevices are the devices found in the inactive domain definition, this is only
+	// populated for machines whose persistence mode includes the config
+	ConfigDevices map[string]Device
 }
 
-func (m Machine) String() string {
-	return fmt.Sprintf("%s (ID=%d, UUID=%x): %d attached devices", m.Domain.Name, m.Domain.ID, m.Domain.UUID, len(m.Devices))
+func (m Machine) Key() string {
+	return fmt.Sprintf("%s@%s", m.Domain.Name, m.URI)
 }
 
-func MachineFromLibvirtDomain(l *libvirt.Libvirt, domain libvirt.Domain) (*Machine, error) {
-	domxml, err := l.DomainGetXMLDesc(domain, 0)
-	if err != nil {
-		return nil, err
-	}
+func (m Machine) String() string {
+	return fmt.Sprintf("%s (ID=%d, UUID=%x): %d attached devices, %d static devices", m.Key(), m.Domain.ID, m.Domain.UUID, len(m.Devices), len(m.StaticDevices))
+}
 
+func hostdevsFromDomainXML(domxml string) (managed map[string]Device, static map[string]Device, err error) {
 	domdata, err := xmlquery.Parse(strings.NewReader(domxml))
 	if err != nil {
-		return nil, err
+		return nil, nil, err
 	}
 	hostdevs := xmlquery.Find(domdata, "/domain/devices/hostdev[@type='usb']")
 
-	m := &Machine{Domain: domain}
-	m.Devices = make(map[string]Device)
+	managed = make(map[string]Device)
+	static = make(map[string]Device)
 	for _, hostdev := range hostdevs {
+		if !IsManagedHostdev(hostdev) {
+			if dev, err := NewDeviceFromLibVirtHostdev(hostdev); err == nil {
+				static[dev.Slug()] = dev
+			}
+			// we don't care about static hostdevs we can't parse
+			continue
+		}
 		dev, err := NewDeviceFromLibVirtHostdev(hostdev)
 		if err != nil {
-			return nil, err
+			return nil, nil, err
 		}
-		m.Devices[dev.Slug()] = dev
+		managed[dev.Slug()] = dev
 	}
-	return m, nil
+	return
 }
 
-func NewVirshConnection() (*libvirt.Libvirt, error) {
-	uri, err := url.Parse(string(libvirt.QEMUSystem))
+// MachineFromLibvirtDomain reads the devices of the domain. If withConfig is set, the
+// devices of the inactive domain definition are read as well.
+func MachineFromLibvirtDomain(l *libvirt.Libvirt, domain libvirt.Domain, withConfig bool) (*Machine, error) {
+	domxml, err := l.DomainGetXMLDesc(domain, 0)
 	if err != nil {
 		return nil, err
 	}
 
-	l, err := libvirt.ConnectToURI(uri)
+	m := &Machine{Domain: domain}
+	if m.Devices, m.StaticDevices, err = hostdevsFromDomainXML(domxml); err != nil {
+		return nil, err
+	}
+	if !withConfig {
+		return m, nil
+	}
+
+	domxml, err = l.DomainGetXMLDesc(domain, libvirt.DomainXMLInactive)
 	if err != nil {
 		return nil, err
 	}
-	return l, nil
+	if m.ConfigDevices, _, err = hostdevsFromDomainXML(domxml); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+type MachineEvent struct {
+	URI    string
+	Domain string
+	Event  libvirt.DomainEventType
+	Detail int32
+}
+
+func (e MachineEvent) String() string {
+	switch e.Event {
+	case libvirt.DomainEventStarted:
+		switch libvirt.DomainEventStartedDetailType(e.Detail) {
+		case libvirt.DomainEventStartedMigrated:
+			return "migrated to this host"
+		case libvirt.DomainEventStartedRestored:
+			return "restored"
+		}
+		return "started"
+	case libvirt.DomainEventResumed:
+		return "resumed"
+	case libvirt.DomainEventStopped:
+		if libvirt.DomainEventStoppedDetailType(e.Detail) == libvirt.DomainEventStoppedMigrated {
+			return "migrated to another host"
+		}
+		return "stopped"
+	}
+	return fmt.Sprintf("event %d (detail: %d)", e.Event, e.Detail)
 }
 
-func ListActiveVirtualMachines(conf *Config) (map[string]Machine, error) {
-	l, err := NewVirshConnection()
+func listVirtualMachinesOfURI(conns *LibvirtConnections, conf *Config, uri string, names []string, active bool) (map[string]Machine, error) {
+	l, err := conns.Get(uri)
 	if err != nil {
+		if errors.Is(err, ErrLibvirtNotConnected) {
+			// we will do a full run for these machines as soon as the connection is back
+			wdl.Printf("libvirt at %s is not connected, skipping machines: %s", uri, strings.Join(names, ", "))
+			return nil, nil
+		}
 		return nil, err
 	}
-	defer l.Disconnect() //nolint:errcheck
 
 	machines := make(map[string]Machine)
-	for mname := range conf.Machines {
-		domain, err := l.DomainLookupByName(mname)
+	for _, mname := range names {
+		mconf := conf.Machines[mname]
+		domain, err := l.DomainLookupByName(mconf.Domain)
 		if err != nil {
 			if libvirt.IsNotFound(err) {
 				continue
@@ -105,44 +166,114 @@ func ListActiveVirtualMachines(conf *Config) (map[string]Machine, error) {
 		if err != nil {
 			return nil, err
 		}
-		if state == 0 {
+		if (state != 0) != active {
 			continue
 		}
 
-		machine, err := MachineFromLibvirtDomain(l, domain)
+		machine, err := MachineFromLibvirtDomain(l, domain, mconf.Persistence == persistenceLiveConfig)
 		if err != nil {
 			return nil, err
 		}
-		machines[domain.Name] = *machine
+		machine.Name = mname
+		machine.URI = uri
+		machines[mname] = *machine
 	}
-
 	return machines, nil
 }
 
-func AttachDeviceToVirtualMachine(machine Machine, device Device) error {
-	l, err := NewVirshConnection()
+func listVirtualMachines(conns *LibvirtConnections, conf *Config, names []string, active bool) (map[string]Machine, []string, error) {
+	if len(names) == 0 {
+		for mname := range conf.Machines {
+			names = append(names, mname)
+		}
+	}
+	byURI := make(map[string][]string)
+	for _, mname := range names {
+		if mconf, exists := conf.Machines[mname]; exists {
+			byURI[mconf.LibvirtURI] = append(byURI[mconf.LibvirtURI], mname)
+		}
+	}
+
+	var errs []error
+	var unreachable []string
+	machines := make(map[string]Machine)
+	for uri, names := range byURI {
+		result, err := listVirtualMachinesOfURI(conns, conf, uri, names, active)
+		if err != nil {
+			errs = append(errs, fmt.Errorf("%s: %v", uri, err))
+		}
+		if result == nil {
+			unreachable = append(unreachable, uri)
+			continue
+		}
+		maps.Copy(machines, result)
+	}
+	slices.Sort(unreachable)
+	return machines, unreachable, errors.Join(errs...)
+}
+
+// ListActiveVirtualMachines returns the machines which are running and found in the configuration.
+// If names are given only those machines are looked up. The result is keyed by the name of the
+// machine in the configuration. Machines whose libvirt connection is not established or failed are
+// missing from the result, the URIs of these connections and the errors are returned alongside.
+func ListActiveVirtualMachines(conns *LibvirtConnections, conf *Config, names ...string) (map[string]Machine, []string, error) {
+	return listVirtualMachines(conns, conf, names, true)
+}
+
+// ListInactiveVirtualMachines works like ListActiveVirtualMachines but returns machines
+// which are defined but not running.
+func ListInactiveVirtualMachines(conns *LibvirtConnections, conf *Config, names ...string) (map[string]Machine, []string, error) {
+	return listVirtualMachines(conns, conf, names, false)
+}
+
+// MissingVirtualMachines returns the names of all machines whose domain does not exist in
+// libvirt. Machines of libvirt connections that are not established are skipped and the URIs
+// of these connections are returned as unreachable.
+func MissingVirtualMachines(conns *LibvirtConnections, conf *Config) (missing, unreachable []string, err error) {
+	var errs []error
+	for mname, mconf := range conf.Machines {
+		l, err := conns.Get(mconf.LibvirtURI)
+		if err != nil {
+			if !slices.Contains(unreachable, mconf.LibvirtURI) {
+				unreachable = append(unreachable, mconf.LibvirtURI)
+			}
+			continue
+		}
+		if _, err = l.DomainLookupByName(mconf.Domain); err != nil {
+			if libvirt.IsNotFound(err) {
+				missing = append(missing, mname)
+				continue
+			}
+			errs = append(errs, fmt.Errorf("machine %s: %v", mname, err))
+		}
+	}
+	slices.Sort(missing)
+	slices.Sort(unreachable)
+	return missing, unreachable, errors.Join(errs...)
+}
+
+func AttachDeviceToVirtualMachine(conns *LibvirtConnections, machine Machine, device Device, flags libvirt.DomainDeviceModifyFlags) error {
+	l, err := conns.Get(machine.URI)
 	if err != nil {
 		return err
 	}
-	defer l.Disconnect() //nolint:errcheck
 
 	xml, err := device.HostDevXML()
 	if err != nil {
 		return err
 	}
-	return l.DomainAttachDevice(machine.Domain, xml)
+	return l.DomainAttachDeviceFlags(machine.Domain, xml, uint32(flags))
 }
 
-func DetachDeviceFromVirtualMachine(machine Machine, device Device) error {
-	l, err := NewVirshConnection()
+func DetachDeviceFromVirtualMachine(conns *LibvirtConnections, machine Machine, device Device, flags libvirt.DomainDeviceModifyFlags) error {
+	l, err := conns.Get(machine.URI)
 	if err != nil {
 		return err
 	}
-	defer l.Disconnect() //nolint:errcheck
 
 	xml, err := device.HostDevXML()
 	if err != nil {
 		return err
 	}
-	return l.DomainDetachDevice(machine.Domain, xml)
+	return l.DomainDetachDeviceFlags(machine.Domain, xml, uint32(flags))
 }